@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ============================================================
+// Alert rule expressions
+// ============================================================
+//
+// A rule's condition is a small expression over StatusResponse fields,
+// named by their JSON paths:
+//
+//	connected_clients == 0
+//	system.disk_used_gb / system.disk_total_gb > 0.9
+//	containers.status == "down" || containers.health.oom_killed
+//
+// Operators, loosest first: || && ! (== != < <= > >=) (+ -) (* /) and unary
+// -. Literals are numbers, "strings" or 'strings', true and false.
+//
+// Paths are checked against StatusResponse when a rule is loaded, and the
+// expression is type checked, so a typo fails the load instead of never
+// firing. A rule that mentions containers.* is evaluated once per container.
+// A field that is absent from a snapshot (e.g. system when /proc is not
+// mounted) makes the comparisons that use it false.
+
+type exprKind int
+
+const (
+	kindNumber exprKind = iota + 1
+	kindString
+	kindBool
+)
+
+func (k exprKind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	case kindBool:
+		return "boolean"
+	}
+	return "unknown"
+}
+
+// exprNode is a type-checked expression. eval returns ok=false when a field
+// it needs is missing.
+type exprNode interface {
+	kind() exprKind
+	eval(s *exprScope) (v any, ok bool)
+}
+
+// exprScope is what an expression is evaluated against: the snapshot as
+// decoded JSON and, for per-container rules, the current container.
+type exprScope struct {
+	status    map[string]any
+	container map[string]any
+}
+
+// compiledExpr is a parsed and type-checked condition.
+type compiledExpr struct {
+	cond         exprNode
+	value        exprNode // left side of a top-level comparison, reported as the alert value
+	perContainer bool
+}
+
+func compileAlertExpr(src string) (*compiledExpr, error) {
+	toks, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	if n.kind() != kindBool {
+		return nil, fmt.Errorf("condition is a %s, not a boolean", n.kind())
+	}
+
+	c := &compiledExpr{cond: n, perContainer: p.perContainer}
+	if b, ok := n.(*binaryExpr); ok && isComparison(b.op) && b.l.kind() == kindNumber {
+		c.value = b.l
+	}
+	return c, nil
+}
+
+// holds reports whether the condition is true in s; missing data counts as false.
+func (c *compiledExpr) holds(s *exprScope) bool {
+	v, ok := c.cond.eval(s)
+	return ok && v == true
+}
+
+// valueIn returns the reported value in s, or nil.
+func (c *compiledExpr) valueIn(s *exprScope) *float64 {
+	if c.value == nil {
+		return nil
+	}
+	if v, ok := c.value.eval(s); ok {
+		f := v.(float64)
+		return &f
+	}
+	return nil
+}
+
+// ============================================================
+// Tokenizer
+// ============================================================
+
+type tokenType int
+
+const (
+	tokNumber tokenType = iota
+	tokString
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	typ  tokenType
+	text string
+}
+
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "(", ")"}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, exprToken{tokNumber, src[i:j]})
+			i = j
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(src[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, exprToken{tokString, src[i+1 : i+1+j]})
+			i += j + 2
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] >= 'a' && src[j] <= 'z' ||
+				src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, exprToken{tokIdent, src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			toks = append(toks, exprToken{tokOp, op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+// ============================================================
+// Parser
+// ============================================================
+
+type exprParser struct {
+	toks         []exprToken
+	pos          int
+	perContainer bool
+}
+
+func (p *exprParser) peekOp(ops ...string) string {
+	if p.pos < len(p.toks) && p.toks[p.pos].typ == tokOp {
+		for _, op := range ops {
+			if p.toks[p.pos].text == op {
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+// binary parses a left-associative chain of ops over next.
+func (p *exprParser) binary(next func() (exprNode, error), ops ...string) (exprNode, error) {
+	l, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOp(ops...)
+		if op == "" {
+			return l, nil
+		}
+		p.pos++
+		r, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if l, err = newBinaryExpr(op, l, r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseOr() (exprNode, error)      { return p.binary(p.parseAnd, "||") }
+func (p *exprParser) parseAnd() (exprNode, error)     { return p.binary(p.parseNot, "&&") }
+func (p *exprParser) parseSum() (exprNode, error)     { return p.binary(p.parseProduct, "+", "-") }
+func (p *exprParser) parseProduct() (exprNode, error) { return p.binary(p.parseUnary, "*", "/") }
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.peekOp("!") != "" {
+		p.pos++
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if x.kind() != kindBool {
+			return nil, fmt.Errorf("'!' needs a boolean, got a %s", x.kind())
+		}
+		return &unaryExpr{op: "!", x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison allows at most one comparison; a < b < c is an error.
+func (p *exprParser) parseComparison() (exprNode, error) {
+	l, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peekOp("==", "!=", "<=", ">=", "<", ">")
+	if op == "" {
+		return l, nil
+	}
+	p.pos++
+	r, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	return newBinaryExpr(op, l, r)
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peekOp("-") != "" {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if x.kind() != kindNumber {
+			return nil, fmt.Errorf("'-' needs a number, got a %s", x.kind())
+		}
+		return &unaryExpr{op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t.typ {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return &literalExpr{v: f, k: kindNumber}, nil
+	case tokString:
+		return &literalExpr{v: t.text, k: kindString}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &literalExpr{v: t.text == "true", k: kindBool}, nil
+		}
+		path := strings.Split(t.text, ".")
+		k, perContainer, err := statusFieldKind(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.text, err)
+		}
+		if perContainer {
+			p.perContainer = true
+			path = path[1:]
+		}
+		return &fieldExpr{path: path, k: k, perContainer: perContainer}, nil
+	}
+	if t.text == "(" {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peekOp(")") == "" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// statusFieldKind resolves a dotted JSON path in StatusResponse to the kind
+// of its value. containers.* paths refer to the current container.
+func statusFieldKind(path []string) (kind exprKind, perContainer bool, err error) {
+	t := reflect.TypeOf(StatusResponse{})
+	for i, seg := range path {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := fieldByJSONName(t, seg)
+			if !ok {
+				return 0, false, fmt.Errorf("unknown field %q", seg)
+			}
+			t = f.Type
+			if t.Kind() == reflect.Slice {
+				if i != 0 || seg != "containers" {
+					return 0, false, fmt.Errorf("%q is a list; only containers.* can be used", seg)
+				}
+				perContainer = true
+				t = t.Elem()
+			}
+		case reflect.Map:
+			t = t.Elem() // seg is a key, e.g. connections.states.ESTABLISHED
+		default:
+			return 0, false, fmt.Errorf("%q has no fields", strings.Join(path[:i], "."))
+		}
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return kindBool, perContainer, nil
+	case reflect.String:
+		return kindString, perContainer, nil
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		return kindNumber, perContainer, nil
+	}
+	return 0, false, fmt.Errorf("not a number, string or boolean")
+}
+
+// fieldByJSONName finds the field of struct type t serialized under name.
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if n, _ := jsonField(t.Field(i)); n == name {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// ============================================================
+// Nodes
+// ============================================================
+
+type literalExpr struct {
+	v any
+	k exprKind
+}
+
+func (e *literalExpr) kind() exprKind              { return e.k }
+func (e *literalExpr) eval(*exprScope) (any, bool) { return e.v, true }
+
+type fieldExpr struct {
+	path         []string
+	k            exprKind
+	perContainer bool
+}
+
+func (e *fieldExpr) kind() exprKind { return e.k }
+
+func (e *fieldExpr) eval(s *exprScope) (any, bool) {
+	var v any = s.status
+	if e.perContainer {
+		v = s.container
+	}
+	for _, seg := range e.path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	switch v.(type) {
+	case float64:
+		return v, e.k == kindNumber
+	case string:
+		return v, e.k == kindString
+	case bool:
+		return v, e.k == kindBool
+	}
+	return nil, false
+}
+
+type unaryExpr struct {
+	op string
+	x  exprNode
+}
+
+func (e *unaryExpr) kind() exprKind { return e.x.kind() }
+
+func (e *unaryExpr) eval(s *exprScope) (any, bool) {
+	v, ok := e.x.eval(s)
+	if !ok {
+		return nil, false
+	}
+	if e.op == "!" {
+		return !v.(bool), true
+	}
+	return -v.(float64), true
+}
+
+type binaryExpr struct {
+	op   string
+	l, r exprNode
+	k    exprKind
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func newBinaryExpr(op string, l, r exprNode) (exprNode, error) {
+	lk, rk := l.kind(), r.kind()
+	switch {
+	case op == "&&" || op == "||":
+		if lk != kindBool || rk != kindBool {
+			return nil, fmt.Errorf("'%s' needs booleans, got a %s and a %s", op, lk, rk)
+		}
+		return &binaryExpr{op: op, l: l, r: r, k: kindBool}, nil
+	case op == "==" || op == "!=":
+		if lk != rk {
+			return nil, fmt.Errorf("cannot compare a %s with a %s", lk, rk)
+		}
+		return &binaryExpr{op: op, l: l, r: r, k: kindBool}, nil
+	case isComparison(op):
+		if lk != kindNumber || rk != kindNumber {
+			return nil, fmt.Errorf("'%s' needs numbers, got a %s and a %s", op, lk, rk)
+		}
+		return &binaryExpr{op: op, l: l, r: r, k: kindBool}, nil
+	}
+	if lk != kindNumber || rk != kindNumber {
+		return nil, fmt.Errorf("'%s' needs numbers, got a %s and a %s", op, lk, rk)
+	}
+	return &binaryExpr{op: op, l: l, r: r, k: kindNumber}, nil
+}
+
+func (e *binaryExpr) kind() exprKind { return e.k }
+
+func (e *binaryExpr) eval(s *exprScope) (any, bool) {
+	l, lok := e.l.eval(s)
+
+	// && and || only need the right side if the left doesn't decide.
+	switch e.op {
+	case "&&":
+		if lok && l == false {
+			return false, true
+		}
+		r, rok := e.r.eval(s)
+		if rok && r == false {
+			return false, true
+		}
+		return true, lok && rok
+	case "||":
+		if lok && l == true {
+			return true, true
+		}
+		r, rok := e.r.eval(s)
+		if rok && r == true {
+			return true, true
+		}
+		return false, lok && rok
+	}
+
+	r, rok := e.r.eval(s)
+	if !lok || !rok {
+		return nil, false
+	}
+	switch e.op {
+	case "==":
+		return l == r, true
+	case "!=":
+		return l != r, true
+	}
+
+	a, b := l.(float64), r.(float64)
+	switch e.op {
+	case "<":
+		return a < b, true
+	case "<=":
+		return a <= b, true
+	case ">":
+		return a > b, true
+	case ">=":
+		return a >= b, true
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		if b == 0 {
+			return nil, false
+		}
+		return a / b, true
+	}
+	return nil, false
+}
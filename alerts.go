@@ -0,0 +1,302 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Alerting (GET /alerts)
+// ============================================================
+//
+// Rules are evaluated against every poll result. An alert for a rule (and,
+// for containers.* rules, a container) is pending while its condition holds
+// and fires once it has held for the rule's for duration. When the condition
+// stops holding, a pending alert is dropped and a firing one is resolved;
+// resolved alerts stay listed for CONDUIT_ALERT_RESOLVED_RETENTION. Each
+// instance exists once, however many polls it spans, so every transition is
+// reported once.
+//
+// Rules come from CONDUIT_ALERT_RULES_FILE; without it, defaultAlertRules
+// apply. See alertexpr.go for the condition syntax.
+
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// defaultAlertRules are used when no rules file is configured.
+var defaultAlertRules = []AlertRule{
+	{Name: "container_down", Expr: `containers.status == "down"`, For: "2m", Severity: severityCritical,
+		Summary: "Container is not running"},
+	{Name: "container_oom_killed", Expr: "containers.health.oom_killed", Severity: severityCritical,
+		Summary: "Container was killed for running out of memory"},
+	{Name: "no_clients", Expr: "total_containers > 0 && connected_clients == 0", For: "15m", Severity: severityWarning,
+		Summary: "No clients connected"},
+	{Name: "disk_almost_full", Expr: "system.disk_used_gb / system.disk_total_gb > 0.9", For: "5m", Severity: severityWarning,
+		Summary: "Disk is more than 90% full"},
+}
+
+// alertRule is a loaded AlertRule.
+type alertRule struct {
+	AlertRule
+	expr *compiledExpr
+	dur  time.Duration
+}
+
+type alertKey struct {
+	rule      string
+	container string
+}
+
+// AlertEngine evaluates the rules and keeps the current alerts.
+type AlertEngine struct {
+	rules     []*alertRule
+	retention time.Duration
+
+	// Notify, if set, is called for every alert that fires or resolves.
+	Notify func(Alert)
+
+	mu          sync.Mutex
+	alerts      map[alertKey]*Alert
+	evaluatedAt int64
+}
+
+// NewAlertEngine loads the rules file, or the default rules if none is set.
+func NewAlertEngine(cfg *Config) (*AlertEngine, error) {
+	defs := defaultAlertRules
+	if cfg.AlertRulesFile != "" {
+		var err error
+		if defs, err = loadAlertRulesFile(cfg.AlertRulesFile); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &AlertEngine{retention: cfg.AlertRetention, alerts: make(map[alertKey]*Alert)}
+	seen := make(map[string]bool)
+	for _, d := range defs {
+		r, err := compileAlertRule(d)
+		if err != nil {
+			return nil, err
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("rule %q: duplicate name", r.Name)
+		}
+		seen[r.Name] = true
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+func loadAlertRulesFile(path string) ([]AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []AlertRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return file.Rules, nil
+}
+
+func compileAlertRule(d AlertRule) (*alertRule, error) {
+	if d.Name == "" {
+		return nil, fmt.Errorf("rule with expr %q: missing name", d.Expr)
+	}
+	r := &alertRule{AlertRule: d}
+	if r.Severity == "" {
+		r.Severity = severityWarning
+	}
+	switch r.Severity {
+	case severityInfo, severityWarning, severityCritical:
+	default:
+		return nil, fmt.Errorf("rule %q: severity must be info, warning or critical", d.Name)
+	}
+	if d.For != "" {
+		dur, err := time.ParseDuration(d.For)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("rule %q: invalid for %q", d.Name, d.For)
+		}
+		r.dur = dur
+	}
+	expr, err := compileAlertExpr(d.Expr)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %w", d.Name, err)
+	}
+	r.expr = expr
+	return r, nil
+}
+
+// Evaluate runs every rule against resp and updates the alerts. It is meant
+// to be passed to pollLoop as a hook.
+func (e *AlertEngine) Evaluate(resp *StatusResponse) {
+	now := resp.Timestamp
+	data, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("alerts: cannot serialize status", "error", err)
+		return
+	}
+	scope := &exprScope{}
+	if err := json.Unmarshal(data, &scope.status); err != nil {
+		slog.Error("alerts: cannot serialize status", "error", err)
+		return
+	}
+	containers, _ := scope.status["containers"].([]any)
+
+	// Without a container list, per-container alerts keep their state
+	// rather than resolving because the containers seem gone.
+	listed := !slices.ContainsFunc(resp.Warnings, func(w StatusIssue) bool { return w.Code == issueDiscoveryFailed })
+
+	active := make(map[alertKey]*float64)
+	for _, r := range e.rules {
+		if !r.expr.perContainer {
+			if r.expr.holds(scope) {
+				active[alertKey{rule: r.Name}] = r.expr.valueIn(scope)
+			}
+			continue
+		}
+		for _, c := range containers {
+			scope.container, _ = c.(map[string]any)
+			if r.expr.holds(scope) {
+				name, _ := scope.container["name"].(string)
+				active[alertKey{r.Name, name}] = r.expr.valueIn(scope)
+			}
+		}
+		scope.container = nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.evaluatedAt = now
+
+	var changed []Alert
+	for _, r := range e.rules {
+		for k, a := range e.alerts {
+			if k.rule != r.Name {
+				continue
+			}
+			if _, ok := active[k]; ok || (r.expr.perContainer && !listed) {
+				continue
+			}
+			switch a.State {
+			case alertPending:
+				delete(e.alerts, k)
+			case alertFiring:
+				a.State, a.ResolvedAt = alertResolved, now
+				changed = append(changed, *a)
+			case alertResolved:
+				if now-a.ResolvedAt >= int64(e.retention.Seconds()) {
+					delete(e.alerts, k)
+				}
+			}
+		}
+		for k, v := range active {
+			if k.rule != r.Name {
+				continue
+			}
+			a := e.alerts[k]
+			if a == nil || a.State == alertResolved {
+				a = &Alert{
+					Rule: r.Name, Container: k.container, Severity: r.Severity, Summary: r.Summary,
+					Expr: r.Expr, State: alertPending, ActiveSince: now,
+				}
+				e.alerts[k] = a
+			}
+			a.Value = v
+			if a.State == alertPending && now-a.ActiveSince >= int64(r.dur.Seconds()) {
+				a.State, a.FiredAt = alertFiring, now
+				changed = append(changed, *a)
+			}
+		}
+	}
+
+	for _, a := range changed {
+		logAlert(a)
+		if e.Notify != nil {
+			e.Notify(a)
+		}
+	}
+}
+
+func logAlert(a Alert) {
+	attrs := []any{"rule", a.Rule, "severity", a.Severity}
+	if a.Container != "" {
+		attrs = append(attrs, "container", a.Container)
+	}
+	if a.Value != nil {
+		attrs = append(attrs, "value", *a.Value)
+	}
+	if a.State == alertFiring {
+		slog.Warn("alert firing", attrs...)
+	} else {
+		slog.Info("alert resolved", attrs...)
+	}
+}
+
+// alertStateOrder sorts firing alerts first.
+var alertStateOrder = map[string]int{alertFiring: 0, alertPending: 1, alertResolved: 2}
+
+// Snapshot returns the alerts in the given states (all if none), firing
+// first, then oldest first.
+func (e *AlertEngine) Snapshot(states []string) *AlertsResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := &AlertsResponse{EvaluatedAt: e.evaluatedAt, Alerts: []Alert{}}
+	for _, a := range e.alerts {
+		if len(states) == 0 || slices.Contains(states, a.State) {
+			out.Alerts = append(out.Alerts, *a)
+		}
+	}
+	slices.SortFunc(out.Alerts, func(a, b Alert) int {
+		if d := alertStateOrder[a.State] - alertStateOrder[b.State]; d != 0 {
+			return d
+		}
+		return cmp.Or(
+			cmp.Compare(a.ActiveSince, b.ActiveSince),
+			strings.Compare(a.Rule, b.Rule),
+			strings.Compare(a.Container, b.Container),
+		)
+	})
+	for _, r := range e.rules {
+		out.Rules = append(out.Rules, r.AlertRule)
+	}
+	return out
+}
+
+// alertsHandler serves GET /alerts.
+func alertsHandler(e *AlertEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var states []string
+		for _, s := range strings.Split(r.URL.Query().Get("state"), ",") {
+			switch s = strings.TrimSpace(s); s {
+			case "":
+			case alertPending, alertFiring, alertResolved:
+				states = append(states, s)
+			default:
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid 'state': %q", s))
+				return
+			}
+		}
+
+		out := e.Snapshot(states)
+		out.APIVersion = requestAPIVersion(r)
+		writeAPIJSON(w, r, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ============================================================
+// API versions
+// ============================================================
+//
+// Every route is served under /v1/... (one prefix per entry in apiVersions)
+// and, as an alias for the newest version, without a prefix. A released
+// version's schema is frozen: a field added later names the version it
+// first appears in,
+//
+//	Foo int `json:"foo" api:"v2"`
+//
+// and is left out of the responses and the OpenAPI document of older
+// versions. Removing, renaming or retyping a field needs a new version too.
+//
+//	v2  containers[].errors and warnings in StatusResponse
+
+// apiVersions lists the served API versions, oldest first.
+var apiVersions = []string{"v1", "v2"}
+
+func latestAPIVersion() string {
+	return apiVersions[len(apiVersions)-1]
+}
+
+type apiVersionContextKey struct{}
+
+// withAPIVersion marks requests to next as belonging to version.
+func withAPIVersion(version string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), apiVersionContextKey{}, version)))
+	}
+}
+
+// requestAPIVersion returns the API version r was routed to, defaulting to
+// the newest.
+func requestAPIVersion(r *http.Request) string {
+	if v, ok := r.Context().Value(apiVersionContextKey{}).(string); ok {
+		return v
+	}
+	return latestAPIVersion()
+}
+
+func apiVersionNumber(v string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(v, "v"))
+	return n
+}
+
+// fieldInVersion reports whether struct field f is part of version.
+func fieldInVersion(f reflect.StructField, version string) bool {
+	since := f.Tag.Get("api")
+	return since == "" || apiVersionNumber(since) <= apiVersionNumber(version)
+}
+
+// jsonField returns the JSON key of f ("" if it isn't encoded) and whether
+// it is omitempty. Embedded structs without a JSON name return "".
+func jsonField(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if !f.IsExported() || tag == "-" || (f.Anonymous && tag == "") {
+		return "", false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, strings.Contains(","+opts+",", ",omitempty,")
+}
+
+// embeddedStruct returns the struct type promoted by an untagged embedded
+// field, or nil.
+func embeddedStruct(f reflect.StructField) reflect.Type {
+	if !f.Anonymous || f.Tag.Get("json") != "" {
+		return nil
+	}
+	t := f.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// ============================================================
+// Shaping responses for older versions
+// ============================================================
+
+type versionFieldsKey struct {
+	t       reflect.Type
+	version string
+}
+
+var versionFieldsCache sync.Map // versionFieldsKey -> fieldTree
+
+// versionFields returns the selection (see statusquery.go) that removes
+// fields newer than version from t's JSON form, or nil if there are none.
+// Types used as map values are kept whole.
+func versionFields(t reflect.Type, version string) fieldTree {
+	key := versionFieldsKey{t, version}
+	if sel, ok := versionFieldsCache.Load(key); ok {
+		return sel.(fieldTree)
+	}
+	sel, _ := buildVersionFields(t, version)
+	versionFieldsCache.Store(key, sel)
+	return sel
+}
+
+// buildVersionFields returns the selection for t and whether it drops anything.
+func buildVersionFields(t reflect.Type, version string) (fieldTree, bool) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	sel := fieldTree{}
+	if !addVersionFields(t, version, sel) {
+		return nil, false
+	}
+	return sel, true
+}
+
+func addVersionFields(t reflect.Type, version string, sel fieldTree) bool {
+	dropped := false
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !fieldInVersion(f, version) {
+			dropped = true
+			continue
+		}
+		if et := embeddedStruct(f); et != nil {
+			dropped = addVersionFields(et, version, sel) || dropped
+			continue
+		}
+		name, _ := jsonField(f)
+		if name == "" {
+			continue
+		}
+		sub, d := buildVersionFields(f.Type, version)
+		sel[name] = sub
+		dropped = dropped || d
+	}
+	return dropped
+}
+
+// marshalVersioned encodes v as JSON in the shape of the given API version.
+func marshalVersioned(v any, version string) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sel := versionFields(reflect.TypeOf(v), version)
+	if sel == nil {
+		return data, nil
+	}
+
+	var tree any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return json.Marshal(selectFields(tree, sel))
+}
+
+// writeAPIJSON writes v with the given status code in the shape of the
+// request's API version.
+func writeAPIJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	data, err := marshalVersioned(v, requestAPIVersion(r))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
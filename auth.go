@@ -0,0 +1,367 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Request Authentication
+// ============================================================
+//
+// Two schemes are supported:
+//
+//  1. Signed requests (preferred). The client sends
+//
+//	X-Conduit-Key-Id:    <token name> (omit for CONDUIT_AUTH_SECRET)
+//	X-Conduit-Timestamp: <unix seconds>
+//	X-Conduit-Nonce:     <random string, 16-128 chars>
+//	X-Conduit-Signature: hex(HMAC-SHA256(key, METHOD "\n" REQUEST_URI "\n" TIMESTAMP "\n" NONCE))
+//
+//     where key = HMAC-SHA256(token, "conduit-expose request signing") and
+//     REQUEST_URI is the path plus query exactly as sent. Requests outside the
+//     allowed clock skew or reusing a nonce are rejected.
+//
+//  2. Legacy static header X-Conduit-Auth: <token>, kept for old dashboards
+//     and disabled with CONDUIT_AUTH_LEGACY=false.
+//
+// Besides the master secret, named tokens with scopes, expiry and source
+// CIDR restrictions can be loaded from CONDUIT_TOKENS_FILE (see tokens.go).
+
+const (
+	headerLegacyAuth = "X-Conduit-Auth"
+	headerKeyID      = "X-Conduit-Key-Id"
+	headerTimestamp  = "X-Conduit-Timestamp"
+	headerNonce      = "X-Conduit-Nonce"
+	headerSignature  = "X-Conduit-Signature"
+
+	signingKeyLabel = "conduit-expose request signing"
+
+	minNonceLength = 16
+	maxNonceLength = 128
+)
+
+var (
+	errAuthMissing   = errors.New("missing credentials")
+	errAuthInvalid   = errors.New("invalid credentials")
+	errAuthSkew      = errors.New("timestamp outside allowed skew")
+	errAuthReplay    = errors.New("nonce already used")
+	errAuthNonceFull = errors.New("too many recent nonces for token")
+	errAuthBadNonce  = errors.New("invalid nonce")
+	errAuthLegacyOff = errors.New("static auth header disabled")
+	errAuthExpired   = errors.New("token expired")
+	errAuthSource    = errors.New("source address not allowed for token")
+)
+
+// Authenticator verifies incoming requests against the master secret and
+// the named tokens.
+type Authenticator struct {
+	master      *apiToken
+	allowLegacy bool
+	maxSkew     time.Duration
+	nonces      *nonceCache
+
+	mu     sync.RWMutex
+	tokens map[string]*apiToken // named tokens by name
+
+	// OnFailure and OnSuccess, if set, are called by authMiddleware with the
+	// client IP after a request that presented credentials.
+	OnFailure func(ip net.IP)
+	OnSuccess func(ip net.IP)
+
+	// Unauthorized, if set, answers requests that fail authentication in
+	// place of the JSON 401 (see camouflage.go).
+	Unauthorized http.Handler
+}
+
+// NewAuthenticator creates an Authenticator from the runtime config. If a
+// tokens file is configured it must load successfully.
+func NewAuthenticator(cfg *Config) (*Authenticator, error) {
+	a := &Authenticator{
+		master:      newAPIToken(masterTokenName, cfg.AuthSecret, []string{scopeAll}),
+		allowLegacy: cfg.AuthLegacy,
+		maxSkew:     cfg.AuthMaxSkew,
+		nonces:      newNonceCache(cfg.AuthNonceCache),
+		tokens:      map[string]*apiToken{},
+	}
+	if cfg.TokensReload < 0 {
+		return nil, errors.New("CONDUIT_TOKENS_RELOAD must not be negative")
+	}
+	if cfg.TokensFile != "" {
+		tokens, err := loadTokensFile(cfg.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+	return a, nil
+}
+
+func (a *Authenticator) setTokens(tokens map[string]*apiToken) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens = tokens
+}
+
+// lookup returns the token with the given name ("" or "master" is the master secret).
+func (a *Authenticator) lookup(name string) *apiToken {
+	if name == "" || name == masterTokenName {
+		return a.master
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.tokens[name]
+}
+
+// deriveSigningKey derives the HMAC key used for request signatures, so the
+// raw secret itself is never used directly as a MAC key.
+func deriveSigningKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingKeyLabel))
+	return mac.Sum(nil)
+}
+
+// signRequest computes the hex signature for the given request fields.
+func signRequest(key []byte, method, requestURI, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify identifies the token behind a request, preferring a signature when
+// present, and checks its expiry and source restrictions.
+func (a *Authenticator) Verify(r *http.Request) (*apiToken, error) {
+	var token *apiToken
+	var err error
+	if r.Header.Get(headerSignature) != "" {
+		token, err = a.verifySigned(r)
+	} else {
+		token, err = a.verifyLegacy(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Expired(time.Now()) {
+		return token, errAuthExpired
+	}
+	if !token.AllowsIP(clientIP(r)) {
+		return token, errAuthSource
+	}
+	return token, nil
+}
+
+func (a *Authenticator) verifyLegacy(r *http.Request) (*apiToken, error) {
+	value := r.Header.Get(headerLegacyAuth)
+	if value == "" {
+		return nil, errAuthMissing
+	}
+	if !a.allowLegacy {
+		return nil, errAuthLegacyOff
+	}
+
+	// Compare against every token so timing doesn't reveal which one matched.
+	var match *apiToken
+	if subtle.ConstantTimeCompare([]byte(value), a.master.secret) == 1 {
+		match = a.master
+	}
+	a.mu.RLock()
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(value), t.secret) == 1 {
+			match = t
+		}
+	}
+	a.mu.RUnlock()
+
+	if match == nil {
+		return nil, errAuthInvalid
+	}
+	return match, nil
+}
+
+func (a *Authenticator) verifySigned(r *http.Request) (*apiToken, error) {
+	tsHeader := r.Header.Get(headerTimestamp)
+	nonce := r.Header.Get(headerNonce)
+	sig := r.Header.Get(headerSignature)
+
+	token := a.lookup(r.Header.Get(headerKeyID))
+	if token == nil {
+		return nil, errAuthInvalid
+	}
+
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return nil, errAuthInvalid
+	}
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return nil, errAuthBadNonce
+	}
+
+	now := time.Now()
+	reqTime := time.Unix(ts, 0)
+	if reqTime.Before(now.Add(-a.maxSkew)) || reqTime.After(now.Add(a.maxSkew)) {
+		return nil, errAuthSkew
+	}
+
+	expected := signRequest(token.signingKey, r.Method, r.RequestURI, tsHeader, nonce)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return nil, errAuthInvalid
+	}
+
+	// Only remember nonces of valid signatures, so garbage can't fill the cache.
+	// Entries outlive the skew window on both sides of "now".
+	if err := a.nonces.Add(token.Name, nonce, reqTime.Add(a.maxSkew), now); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// clientIP returns the request's client address as resolved by Guard
+// (see ratelimit.go), falling back to the direct peer.
+func clientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the address of the direct peer.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// authMiddleware rejects requests that fail Authenticator.Verify or whose
+// token lacks scope, and logs the token name of every request.
+func authMiddleware(auth *Authenticator, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.Verify(r)
+		if err != nil && err != errAuthMissing && auth.OnFailure != nil {
+			auth.OnFailure(clientIP(r))
+		}
+		if err != nil {
+			if token != nil {
+				slog.Warn("auth: token rejected", "token", token.Name, "ip", clientIP(r).String(),
+					"method", r.Method, "path", r.URL.Path, "error", err)
+			}
+			if auth.Unauthorized != nil {
+				auth.Unauthorized.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"unauthorized"}`))
+			return
+		}
+		if auth.OnSuccess != nil {
+			auth.OnSuccess(clientIP(r))
+		}
+		if !token.Allows(scope) {
+			slog.Warn("auth: token lacks scope", "token", token.Name, "scope", scope, "method", r.Method, "path", r.URL.Path)
+			writeJSONError(w, http.StatusForbidden, "token lacks scope "+scope)
+			return
+		}
+		slog.Info("request", "method", r.Method, "path", r.URL.Path, "token", token.Name, "ip", clientIP(r).String())
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
+	}
+}
+
+type tokenContextKey struct{}
+
+// requestToken returns the token authMiddleware accepted for r, or nil.
+func requestToken(r *http.Request) *apiToken {
+	t, _ := r.Context().Value(tokenContextKey{}).(*apiToken)
+	return t
+}
+
+// ============================================================
+// Nonce cache (replay protection)
+// ============================================================
+
+// nonceCache remembers recently used nonces until they expire, separately
+// for each token. A token holds at most capacity live nonces; only expired
+// ones are evicted, so a client flooding the cache with one token can
+// neither push out another token's nonces nor its own unexpired ones. Once a
+// token's share is full, its further requests are rejected until nonces
+// expire.
+type nonceCache struct {
+	mu       sync.Mutex
+	tokens   map[string]*tokenNonces
+	capacity int
+}
+
+// tokenNonces are one token's nonces, with a min-heap by expiry to find
+// expired ones.
+type tokenNonces struct {
+	expires map[string]time.Time
+	byExp   nonceHeap
+}
+
+type nonceEntry struct {
+	nonce  string
+	expiry time.Time
+}
+
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x any)        { *h = append(*h, x.(nonceEntry)) }
+func (h *nonceHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newNonceCache(capacity int) *nonceCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &nonceCache{tokens: make(map[string]*tokenNonces), capacity: capacity}
+}
+
+// Add records a nonce of token until expiry. It returns errAuthReplay if
+// the nonce is already present and not yet expired, and errAuthNonceFull if
+// the token has capacity live nonces.
+func (c *nonceCache) Add(token, nonce string, expiry, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.tokens[token]
+	if t == nil {
+		t = &tokenNonces{expires: make(map[string]time.Time)}
+		c.tokens[token] = t
+	}
+	for len(t.byExp) > 0 && !now.Before(t.byExp[0].expiry) {
+		e := heap.Pop(&t.byExp).(nonceEntry)
+		if t.expires[e.nonce].Equal(e.expiry) {
+			delete(t.expires, e.nonce)
+		}
+	}
+
+	if _, ok := t.expires[nonce]; ok {
+		return errAuthReplay
+	}
+	if len(t.expires) >= c.capacity {
+		return errAuthNonceFull
+	}
+	t.expires[nonce] = expiry
+	heap.Push(&t.byExp, nonceEntry{nonce, expiry})
+	return nil
+}
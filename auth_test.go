@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedRequest(token *apiToken, method, target, nonce string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(headerKeyID, token.Name)
+	r.Header.Set(headerTimestamp, ts)
+	r.Header.Set(headerNonce, nonce)
+	r.Header.Set(headerSignature, signRequest(token.signingKey, r.Method, r.RequestURI, ts, nonce))
+	return r
+}
+
+func TestNonceCacheFullTokenCannotEvictOthers(t *testing.T) {
+	const capacity = 5
+	a, err := NewAuthenticator(&Config{
+		AuthSecret:     "master-secret-0123456789",
+		AuthMaxSkew:    5 * time.Minute,
+		AuthNonceCache: capacity,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := newAPIToken("reader", "reader-secret-0123456789", []string{scopeStatusRead})
+	a.setTokens(map[string]*apiToken{reader.Name: reader})
+
+	captured := signedRequest(a.master, http.MethodGet, "/status", "master-nonce-0000000001")
+	if _, err := a.Verify(captured); err != nil {
+		t.Fatalf("master request: %v", err)
+	}
+
+	for i := range capacity {
+		if _, err := a.Verify(signedRequest(reader, http.MethodGet, "/status", fmt.Sprintf("reader-nonce-%012d", i))); err != nil {
+			t.Fatalf("reader request %d: %v", i, err)
+		}
+	}
+	if _, err := a.Verify(signedRequest(reader, http.MethodGet, "/status", "reader-nonce-overflow01")); err != errAuthNonceFull {
+		t.Fatalf("reader request over capacity: got %v, want %v", err, errAuthNonceFull)
+	}
+
+	if _, err := a.Verify(signedRequest(a.master, http.MethodGet, "/status", "master-nonce-0000000001")); err != errAuthReplay {
+		t.Fatalf("replayed master nonce: got %v, want %v", err, errAuthReplay)
+	}
+	if _, err := a.Verify(signedRequest(a.master, http.MethodGet, "/status", "master-nonce-0000000002")); err != nil {
+		t.Fatalf("fresh master request: %v", err)
+	}
+}
+
+func TestNonceCacheEvictsOnlyExpired(t *testing.T) {
+	c := newNonceCache(2)
+	now := time.Now()
+	if err := c.Add("t", "a", now.Add(time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("t", "b", now.Add(2*time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("t", "c", now.Add(3*time.Minute), now); err != errAuthNonceFull {
+		t.Fatalf("full cache: got %v, want %v", err, errAuthNonceFull)
+	}
+
+	later := now.Add(90 * time.Second) // "a" has expired, "b" has not
+	if err := c.Add("t", "c", later.Add(time.Minute), later); err != nil {
+		t.Fatalf("after expiry: %v", err)
+	}
+	if err := c.Add("t", "b", later.Add(time.Minute), later); err != errAuthReplay {
+		t.Fatalf("live nonce: got %v, want %v", err, errAuthReplay)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================
+// Camouflage mode
+// ============================================================
+//
+// With CONDUIT_CAMOUFLAGE set, anything a prober can reach without valid
+// credentials (unknown paths, failed auth, rate limit and lockout rejections)
+// gets a decoy instead of the agent's JSON errors:
+//
+//	nginx  the stock nginx 404 page with nginx's headers
+//	proxy  whatever CONDUIT_CAMOUFLAGE_UPSTREAM (e.g. a local static site) serves
+//
+// Decoy responses are delayed by a small random amount so the time taken
+// to reject a bad credential doesn't stand out from an unknown path.
+
+const (
+	camouflageOff   = "off"
+	camouflageNginx = "nginx"
+	camouflageProxy = "proxy"
+
+	decoyMaxJitter = 5 * time.Millisecond
+)
+
+// nginx's built-in 404 page (server_tokens off), CRLF line endings included.
+const nginx404Body = "<html>\r\n" +
+	"<head><title>404 Not Found</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>404 Not Found</h1></center>\r\n" +
+	"<hr><center>nginx</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+// Camouflage serves decoy responses to unauthenticated requests.
+type Camouflage struct {
+	mode  string
+	proxy *httputil.ReverseProxy
+}
+
+// NewCamouflage returns the configured Camouflage, or nil when the mode is off.
+func NewCamouflage(cfg *Config) (*Camouflage, error) {
+	switch cfg.Camouflage {
+	case "", camouflageOff:
+		return nil, nil
+	case camouflageNginx:
+		return &Camouflage{mode: camouflageNginx}, nil
+	case camouflageProxy:
+		if cfg.DecoyUpstream == "" {
+			return nil, errors.New("CONDUIT_CAMOUFLAGE=proxy requires CONDUIT_CAMOUFLAGE_UPSTREAM")
+		}
+		target, err := url.Parse(cfg.DecoyUpstream)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid CONDUIT_CAMOUFLAGE_UPSTREAM %q", cfg.DecoyUpstream)
+		}
+		c := &Camouflage{mode: camouflageProxy}
+		c.proxy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				// Never hand our credentials to the upstream
+				for name := range pr.Out.Header {
+					if strings.HasPrefix(strings.ToLower(name), "x-conduit-") {
+						pr.Out.Header.Del(name)
+					}
+				}
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				writeNginx404(w, r)
+			},
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown CONDUIT_CAMOUFLAGE mode %q", cfg.Camouflage)
+}
+
+// ServeHTTP writes the decoy response.
+func (c *Camouflage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(rand.N(decoyMaxJitter))
+	if c.proxy != nil {
+		c.proxy.ServeHTTP(w, r)
+		return
+	}
+	writeNginx404(w, r)
+}
+
+// Wrap applies camouflage to every response: in nginx mode it adds nginx's
+// Server header, and in both modes it answers non-canonical paths (which
+// http.ServeMux would otherwise redirect) with the decoy.
+func (c *Camouflage) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.mode == camouflageNginx {
+			w.Header().Set("Server", "nginx")
+		}
+		if p := r.URL.Path; p == "" || path.Clean(p) != p {
+			c.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeNginx404(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Server", "nginx")
+	h.Set("Content-Type", "text/html")
+	h.Set("Content-Length", strconv.Itoa(len(nginx404Body)))
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(nginx404Body))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCamouflageHidesWrongMethod(t *testing.T) {
+	cfg := &Config{
+		AuthSecret:     "master-secret-0123456789",
+		AuthMaxSkew:    5 * time.Minute,
+		AuthNonceCache: 100,
+		Camouflage:     camouflageNginx,
+	}
+	auth, err := NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	camo, err := NewCamouflage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Unauthorized = camo
+
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, auth, []apiRoute{{
+		Method: http.MethodPost, Path: "/containers/{id}/start", Scope: scopeContainersControl,
+		Handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+	}})
+	mux.Handle("/", camo)
+	handler := camo.Wrap(mux)
+
+	// Unauthenticated: indistinguishable from an unknown path
+	for _, target := range []string{"/containers/abc/start", "/no/such/path"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound || rec.Body.String() != nginx404Body {
+			t.Errorf("GET %s: got %d %q, want the nginx 404", target, rec.Code, rec.Body.String())
+		}
+		if allow := rec.Header().Get("Allow"); allow != "" {
+			t.Errorf("GET %s: leaked Allow header %q", target, allow)
+		}
+	}
+
+	// Authenticated: the real 405
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, signedRequest(auth.master, http.MethodGet, "/containers/abc/start", "camouflage-nonce-000001"))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("signed GET: got %d Allow=%q, want 405 Allow=POST", rec.Code, rec.Header().Get("Allow"))
+	}
+}
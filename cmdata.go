@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"sort"
 	"strconv"
@@ -291,7 +291,7 @@ func readCMSettings(path string) *CMSettings {
 	}
 
 	if !found {
-		log.Printf("WARN: settings.conf at %s has no recognized settings", path)
+		slog.Warn("settings.conf has no recognized settings", "path", path)
 		return nil
 	}
 
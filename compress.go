@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ============================================================
+// Serialized snapshots, conditional requests and compression
+// ============================================================
+
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+	encodingZstd     = "zstd"
+
+	// Bodies smaller than this are sent uncompressed; the framing overhead
+	// would eat most of the gain.
+	minCompressBytes = 512
+)
+
+// supportedEncodings lists content codings in server preference order,
+// used to break ties between equal q-values.
+var supportedEncodings = []string{encodingBrotli, encodingZstd, encodingGzip}
+
+// zstdEncoder is shared; EncodeAll is safe for concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+
+// statusSnapshot is a StatusResponse serialized once per poll for one API
+// version. Compressed variants are built on first request and then reused
+// until the next poll.
+type statusSnapshot struct {
+	version  string
+	resp     *StatusResponse // with APIVersion set
+	body     []byte
+	etag     string
+	modified time.Time
+
+	mu      sync.Mutex
+	encoded map[string][]byte
+}
+
+func newStatusSnapshot(r *StatusResponse, version string) *statusSnapshot {
+	resp := *r
+	resp.APIVersion = version
+	body, err := marshalVersioned(&resp, version)
+	if err != nil {
+		slog.Error("cannot serialize status", "error", err)
+		body = []byte(`{}`)
+	}
+	body = append(body, '\n')
+
+	sum := sha256.Sum256(body)
+	return &statusSnapshot{
+		version:  version,
+		resp:     &resp,
+		body:     body,
+		etag:     hex.EncodeToString(sum[:8]),
+		modified: time.Unix(r.Timestamp, 0),
+		encoded:  make(map[string][]byte),
+	}
+}
+
+// Encoded returns the body in the given content coding, compressing and
+// caching it on first use. On failure the identity body is returned with
+// encodingIdentity.
+func (s *statusSnapshot) Encoded(enc string) ([]byte, string) {
+	if enc == encodingIdentity {
+		return s.body, enc
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data, ok := s.encoded[enc]; ok {
+		return data, enc
+	}
+	data, err := compressBody(enc, s.body)
+	if err != nil {
+		slog.Warn("compression failed", "encoding", enc, "error", err)
+		return s.body, encodingIdentity
+	}
+	s.encoded[enc] = data
+	return data, enc
+}
+
+// compressBody encodes body with the given content coding.
+func compressBody(enc string, body []byte) ([]byte, error) {
+	if enc == encodingZstd {
+		return zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/2)), nil
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case encodingGzip:
+		w, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	case encodingBrotli:
+		w = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	default:
+		return body, nil
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// negotiateEncoding picks the best supported coding from an Accept-Encoding
+// header: highest q-value first, then server preference. Codings with q=0
+// are excluded, and "*" stands for any coding not listed explicitly.
+func negotiateEncoding(header string) string {
+	if header == "" {
+		return encodingIdentity
+	}
+
+	q := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		if name == "*" {
+			wildcard = weight
+		} else if name != "" {
+			q[name] = weight
+		}
+	}
+
+	best, bestQ := encodingIdentity, 0.0
+	for _, enc := range supportedEncodings {
+		w, ok := q[enc]
+		if !ok {
+			w = wildcard
+		}
+		if w > bestQ {
+			best, bestQ = enc, w
+		}
+	}
+	return best
+}
+
+// variantETag derives the ETag of a filtered representation of a snapshot.
+func variantETag(etag, rawQuery string) string {
+	if rawQuery == "" {
+		return etag
+	}
+	sum := sha256.Sum256([]byte(rawQuery))
+	return etag + "-" + hex.EncodeToString(sum[:4])
+}
+
+// notModified evaluates If-None-Match (weak comparison) or, without it,
+// If-Modified-Since against the representation's validators.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || strings.Trim(tag, `"`) == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// setValidators sets the caching headers shared by every representation
+// of a snapshot.
+func setValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("ETag", `W/"`+etag+`"`)
+	h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// writeEncoded writes a JSON body in the best content coding the client
+// accepts. snap, if non-nil, supplies cached encodings of body.
+func writeEncoded(w http.ResponseWriter, r *http.Request, body []byte, snap *statusSnapshot) {
+	enc := encodingIdentity
+	if len(body) >= minCompressBytes {
+		enc = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	}
+
+	data := body
+	switch {
+	case snap != nil:
+		data, enc = snap.Encoded(enc)
+	case enc != encodingIdentity:
+		var err error
+		if data, err = compressBody(enc, body); err != nil {
+			slog.Warn("compression failed", "encoding", enc, "error", err)
+			data, enc = body, encodingIdentity
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	if enc != encodingIdentity {
+		h.Set("Content-Encoding", enc)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,6 +16,38 @@ const (
 	defaultHostProcPath  = "/host/proc"
 	defaultHostRootPath      = "/host/root"
 	defaultConduitInstallDir = "/opt/conduit"
+	defaultStreamHeartbeat   = 15 * time.Second
+	defaultStreamBuffer      = 4
+	defaultHistoryRetention  = 24 * time.Hour
+	defaultDataDir           = "/var/lib/conduit-expose"
+	defaultAuthMaxSkew       = 5 * time.Minute
+	defaultAuthNonceCache    = 10000
+	defaultTokensReload      = 10 * time.Second
+	defaultControlCooldown   = 30 * time.Second
+	defaultControlConfirm    = 30 * time.Second
+	defaultRateLimit         = 5.0
+	defaultRateBurst         = 20
+	defaultLockoutThreshold  = 5
+	defaultLockoutBase       = time.Minute
+	defaultLockoutMax        = time.Hour
+	defaultHealthPath        = "/health"
+	defaultReadyPath         = "/ready"
+	defaultReadyMaxPollAge   = 3 // poll intervals
+	defaultLogLevel          = "info"
+	defaultLogFormat         = logFormatText
+	defaultLogDedupWindow    = 5 * time.Minute
+	defaultLogsMaxDuration   = 10 * time.Minute
+	defaultLogsMaxRate       = 64 * 1024 // bytes per second
+	defaultPushTimeout       = 10 * time.Second
+	defaultPushQueueSize     = 1000
+	defaultPushBatchSize     = 50
+	defaultPushBackoffMax    = 5 * time.Minute
+	defaultTunnelHeartbeat   = 30 * time.Second
+	defaultTunnelBackoffMax  = time.Minute
+	defaultAlertRetention    = time.Hour
+	defaultNotifyRate        = 30 // messages per hour and channel
+	defaultNotifyRetries     = 3
+	defaultNotifyTimeout     = 10 * time.Second
 
 	conduitImage = "ghcr.io/psiphon-inc/conduit/cli"
 	conduitName  = "conduit"
@@ -23,25 +57,176 @@ const (
 type Config struct {
 	ListenAddr   string
 	AuthSecret   string
+	AuthLegacy   bool
+	AuthMaxSkew  time.Duration
+	AuthNonceCache int
+	TokensFile   string
+	TokensReload time.Duration
 	PollInterval time.Duration
 	DockerTimeout time.Duration
 	MaxWorkers   int
 	HostProcPath      string
 	HostRootPath      string
 	ConduitInstallDir string
+	StreamHeartbeat   time.Duration
+	StreamBuffer      int
+	HistoryRetention  time.Duration
+	DataDir           string
+	TLSEnabled        bool
+	TLSCertFile       string
+	TLSKeyFile        string
+	ControlCooldown   time.Duration
+	ControlConfirm    time.Duration
+	RateLimit         float64
+	RateBurst         int
+	LockoutThreshold  int
+	LockoutBase       time.Duration
+	LockoutMax        time.Duration
+	TrustedProxies    string
+	Camouflage        string
+	DecoyUpstream     string
+	HealthPath        string
+	HealthAuth        bool
+	ReadyPath         string
+	ReadyMaxPollAge   time.Duration
+	PathPrefix        string
+	PathPrefixRotate  time.Duration
+	LogLevel          string
+	LogFormat         string
+	LogDedupWindow    time.Duration
+	LogsScrubIPs      bool
+	LogsMaxDuration   time.Duration
+	LogsMaxRate       int
+	PushURLs          string
+	PushSecret        string
+	PushTimeout       time.Duration
+	PushQueueSize     int
+	PushBatchSize     int
+	PushBackoffMax    time.Duration
+	TunnelURL         string
+	TunnelSecret      string
+	TunnelFingerprint string
+	TunnelHeartbeat   time.Duration
+	TunnelBackoffMax  time.Duration
+	AlertRulesFile    string
+	AlertRetention    time.Duration
+	WebhookURL        string
+	WebhookTemplate   string
+	WebhookSecret     string
+	TelegramToken     string
+	TelegramChatID    string
+	TelegramAPI       string
+	SMTPAddr          string
+	SMTPUser          string
+	SMTPPassword      string
+	SMTPFrom          string
+	SMTPTo            string
+	NotifyTemplate    string
+	NotifyRate        int
+	NotifyRetries     int
+	NotifyTimeout     time.Duration
+	NotifySeverity    string
+	InfluxURL         string
+	InfluxToken       string
+	InfluxPrefix      string
+	StatsDAddr        string
+	StatsDPrefix      string
+	DogStatsD         bool
+	ExportTags        string
 }
 
 func loadConfig() *Config {
-	return &Config{
+	cfg := &Config{
 		ListenAddr:   envOrDefault("CONDUIT_LISTEN_ADDR", defaultListenAddr),
 		AuthSecret:   os.Getenv("CONDUIT_AUTH_SECRET"),
+		AuthLegacy:   envBoolOrDefault("CONDUIT_AUTH_LEGACY", true),
+		AuthMaxSkew:  envDurationOrDefault("CONDUIT_AUTH_MAX_SKEW", defaultAuthMaxSkew),
+		AuthNonceCache: envIntOrDefault("CONDUIT_AUTH_NONCE_CACHE", defaultAuthNonceCache),
+		TokensFile:   os.Getenv("CONDUIT_TOKENS_FILE"),
+		TokensReload: envDurationOrDefault("CONDUIT_TOKENS_RELOAD", defaultTokensReload),
 		PollInterval: envDurationOrDefault("CONDUIT_POLL_INTERVAL", defaultPollInterval),
 		DockerTimeout: defaultDockerTimeout,
 		MaxWorkers:   defaultMaxWorkers,
 		HostProcPath: envOrDefault("CONDUIT_HOST_PROC", defaultHostProcPath),
 		HostRootPath:      envOrDefault("CONDUIT_HOST_ROOT", defaultHostRootPath),
 		ConduitInstallDir: envOrDefault("CONDUIT_INSTALL_DIR", defaultConduitInstallDir),
+		StreamHeartbeat:   envDurationOrDefault("CONDUIT_STREAM_HEARTBEAT", defaultStreamHeartbeat),
+		StreamBuffer:      envIntOrDefault("CONDUIT_STREAM_BUFFER", defaultStreamBuffer),
+		HistoryRetention:  envDurationOrDefault("CONDUIT_HISTORY_RETENTION", defaultHistoryRetention),
+		DataDir:           envOrDefault("CONDUIT_DATA_DIR", defaultDataDir),
+		TLSEnabled:        envBoolOrDefault("CONDUIT_TLS", false),
+		TLSCertFile:       os.Getenv("CONDUIT_TLS_CERT"),
+		TLSKeyFile:        os.Getenv("CONDUIT_TLS_KEY"),
+		ControlCooldown:   envDurationOrDefault("CONDUIT_CONTROL_COOLDOWN", defaultControlCooldown),
+		ControlConfirm:    envDurationOrDefault("CONDUIT_CONTROL_CONFIRM", defaultControlConfirm),
+		RateLimit:         envFloatOrDefault("CONDUIT_RATE_LIMIT", defaultRateLimit),
+		RateBurst:         envIntOrDefault("CONDUIT_RATE_BURST", defaultRateBurst),
+		LockoutThreshold:  envIntOrDefault("CONDUIT_LOCKOUT_THRESHOLD", defaultLockoutThreshold),
+		LockoutBase:       envDurationOrDefault("CONDUIT_LOCKOUT_BASE", defaultLockoutBase),
+		LockoutMax:        envDurationOrDefault("CONDUIT_LOCKOUT_MAX", defaultLockoutMax),
+		TrustedProxies:    os.Getenv("CONDUIT_TRUSTED_PROXIES"),
+		Camouflage:        envOrDefault("CONDUIT_CAMOUFLAGE", "off"),
+		DecoyUpstream:     os.Getenv("CONDUIT_CAMOUFLAGE_UPSTREAM"),
+		HealthPath:        envOrDefault("CONDUIT_HEALTH_PATH", defaultHealthPath),
+		HealthAuth:        envBoolOrDefault("CONDUIT_HEALTH_AUTH", false),
+		ReadyPath:         envOrDefault("CONDUIT_READY_PATH", defaultReadyPath),
+		PathPrefix:        os.Getenv("CONDUIT_PATH_PREFIX"),
+		PathPrefixRotate:  envDurationOrDefault("CONDUIT_PATH_PREFIX_ROTATE", 0),
+		LogLevel:          envOrDefault("CONDUIT_LOG_LEVEL", defaultLogLevel),
+		LogFormat:         envOrDefault("CONDUIT_LOG_FORMAT", defaultLogFormat),
+		LogDedupWindow:    envDurationOrDefault("CONDUIT_LOG_DEDUP_WINDOW", defaultLogDedupWindow),
+		LogsScrubIPs:      envBoolOrDefault("CONDUIT_LOGS_SCRUB_IPS", true),
+		LogsMaxDuration:   envDurationOrDefault("CONDUIT_LOGS_MAX_DURATION", defaultLogsMaxDuration),
+		LogsMaxRate:       envIntOrDefault("CONDUIT_LOGS_MAX_RATE", defaultLogsMaxRate),
+		PushURLs:          os.Getenv("CONDUIT_PUSH_URLS"),
+		PushSecret:        os.Getenv("CONDUIT_PUSH_SECRET"),
+		PushTimeout:       envDurationOrDefault("CONDUIT_PUSH_TIMEOUT", defaultPushTimeout),
+		PushQueueSize:     envIntOrDefault("CONDUIT_PUSH_QUEUE", defaultPushQueueSize),
+		PushBatchSize:     envIntOrDefault("CONDUIT_PUSH_BATCH", defaultPushBatchSize),
+		PushBackoffMax:    envDurationOrDefault("CONDUIT_PUSH_BACKOFF_MAX", defaultPushBackoffMax),
+		TunnelURL:         os.Getenv("CONDUIT_TUNNEL_URL"),
+		TunnelSecret:      os.Getenv("CONDUIT_TUNNEL_SECRET"),
+		TunnelFingerprint: os.Getenv("CONDUIT_TUNNEL_FINGERPRINT"),
+		TunnelHeartbeat:   envDurationOrDefault("CONDUIT_TUNNEL_HEARTBEAT", defaultTunnelHeartbeat),
+		TunnelBackoffMax:  envDurationOrDefault("CONDUIT_TUNNEL_BACKOFF_MAX", defaultTunnelBackoffMax),
+		AlertRulesFile:    os.Getenv("CONDUIT_ALERT_RULES_FILE"),
+		AlertRetention:    envDurationOrDefault("CONDUIT_ALERT_RESOLVED_RETENTION", defaultAlertRetention),
+		WebhookURL:        os.Getenv("CONDUIT_NOTIFY_WEBHOOK_URL"),
+		WebhookTemplate:   os.Getenv("CONDUIT_NOTIFY_WEBHOOK_TEMPLATE"),
+		WebhookSecret:     os.Getenv("CONDUIT_NOTIFY_WEBHOOK_SECRET"),
+		TelegramToken:     os.Getenv("CONDUIT_NOTIFY_TELEGRAM_TOKEN"),
+		TelegramChatID:    os.Getenv("CONDUIT_NOTIFY_TELEGRAM_CHAT_ID"),
+		TelegramAPI:       envOrDefault("CONDUIT_NOTIFY_TELEGRAM_API", defaultTelegramAPI),
+		SMTPAddr:          os.Getenv("CONDUIT_NOTIFY_SMTP_ADDR"),
+		SMTPUser:          os.Getenv("CONDUIT_NOTIFY_SMTP_USER"),
+		SMTPPassword:      os.Getenv("CONDUIT_NOTIFY_SMTP_PASSWORD"),
+		SMTPFrom:          os.Getenv("CONDUIT_NOTIFY_SMTP_FROM"),
+		SMTPTo:            os.Getenv("CONDUIT_NOTIFY_SMTP_TO"),
+		NotifyTemplate:    envOrDefault("CONDUIT_NOTIFY_TEMPLATE", defaultNotifyTemplate),
+		NotifyRate:        envIntOrDefault("CONDUIT_NOTIFY_RATE", defaultNotifyRate),
+		NotifyRetries:     envIntOrDefault("CONDUIT_NOTIFY_RETRIES", defaultNotifyRetries),
+		NotifyTimeout:     envDurationOrDefault("CONDUIT_NOTIFY_TIMEOUT", defaultNotifyTimeout),
+		NotifySeverity:    envOrDefault("CONDUIT_NOTIFY_SEVERITY", severityWarning),
+		InfluxURL:         os.Getenv("CONDUIT_INFLUX_URL"),
+		InfluxToken:       os.Getenv("CONDUIT_INFLUX_TOKEN"),
+		InfluxPrefix:      envOrDefault("CONDUIT_INFLUX_PREFIX", defaultExportPrefix),
+		StatsDAddr:        os.Getenv("CONDUIT_STATSD_ADDR"),
+		StatsDPrefix:      envOrDefault("CONDUIT_STATSD_PREFIX", defaultExportPrefix),
+		DogStatsD:         envBoolOrDefault("CONDUIT_STATSD_DOGSTATSD", false),
+		ExportTags:        os.Getenv("CONDUIT_EXPORT_TAGS"),
 	}
+	if !strings.HasPrefix(cfg.HealthPath, "/") {
+		cfg.HealthPath = "/" + cfg.HealthPath
+	}
+	if !strings.HasPrefix(cfg.ReadyPath, "/") {
+		cfg.ReadyPath = "/" + cfg.ReadyPath
+	}
+	cfg.ReadyMaxPollAge = envDurationOrDefault("CONDUIT_READY_MAX_POLL_AGE", defaultReadyMaxPollAge*cfg.PollInterval)
+	// Providing a certificate implies TLS
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cfg.TLSEnabled = true
+	}
+	return cfg
 }
 
 func envOrDefault(key, fallback string) string {
@@ -70,8 +255,47 @@ func envDurationOrDefault(key string, fallback time.Duration) time.Duration {
 	}
 	d, err := time.ParseDuration(v)
 	if err != nil {
-		log.Printf("WARN: invalid duration for %s=%q, using default %s", key, v, fallback)
+		slog.Warn("invalid duration, using default", "env", key, "value", v, "default", fallback.String())
 		return fallback
 	}
 	return d
 }
+
+func envIntOrDefault(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("invalid integer, using default", "env", key, "value", v, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+func envBoolOrDefault(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("invalid boolean, using default", "env", key, "value", v, "default", fallback)
+		return fallback
+	}
+	return b
+}
+
+func envFloatOrDefault(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn("invalid number, using default", "env", key, "value", v, "default", fallback)
+		return fallback
+	}
+	return f
+}
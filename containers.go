@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// containerDetailHandler serves GET /containers/{id}, where id is a container
+// name or (short) ID. Unlike /status this talks to Docker on every request,
+// since the extended data isn't part of the poll cycle.
+func containerDetailHandler(cli *client.Client, cfg *Config, cache *StatusCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		ctr, err := findContainer(ctx, cli, r.PathValue("id"))
+		if err != nil {
+			writeContainerLookupError(w, err)
+			return
+		}
+
+		detail := &ContainerDetail{}
+
+		// Reuse the poll cycle's view of the container when we have one, so the
+		// numbers match /status; otherwise collect stats now.
+		if info, ok := cachedContainerInfo(cache, ctr.ID); ok {
+			detail.ContainerInfo = info
+		} else {
+			var statsErr error
+			detail.ContainerInfo, statsErr = collectContainerStats(ctx, cli, ctr, cfg)
+			if statsErr != nil {
+				detail.Errors = []StatusIssue{{Code: issueStatsFailed, Message: statsErr.Error(), FirstSeen: time.Now().Unix()}}
+			}
+		}
+
+		inspectCtx, cancel := context.WithTimeout(ctx, cfg.DockerTimeout)
+		inspect, err := cli.ContainerInspect(inspectCtx, ctr.ID)
+		cancel()
+		if err != nil {
+			slog.Warn("cannot inspect container", "container", detail.Name, "stage", stageInspect, "error", err)
+		} else {
+			detail.Inspect = collectContainerInspectInfo(ctx, cli, inspect, cfg)
+			if inspect.State != nil && inspect.State.Pid > 0 {
+				detail.Connections = collectContainerConnections(cfg.HostProcPath, inspect.State.Pid)
+			}
+		}
+
+		if ctr.State == "running" {
+			line, err := fetchLastStatsLine(ctx, cli, ctr.ID, cfg)
+			if err != nil {
+				slog.Warn("container logs unavailable", "container", detail.Name, "stage", stageLogs, "error", err)
+			}
+			detail.LastStatsLine = line
+		}
+
+		detail.APIVersion = requestAPIVersion(r)
+		writeAPIJSON(w, r, http.StatusOK, detail)
+	}
+}
+
+// cachedContainerInfo looks up a container in the latest StatusResponse by full ID.
+func cachedContainerInfo(cache *StatusCache, id string) (ContainerInfo, bool) {
+	resp := cache.Get()
+	if resp == nil {
+		return ContainerInfo{}, false
+	}
+	for _, c := range resp.Containers {
+		if c.ID != "" && strings.HasPrefix(id, c.ID) {
+			return c, true
+		}
+	}
+	return ContainerInfo{}, false
+}
+
+// writeContainerLookupError maps findContainer errors to HTTP responses.
+func writeContainerLookupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errContainerNotFound):
+		writeJSONError(w, http.StatusNotFound, "container not found")
+		return
+	case errors.Is(err, errContainerAmbiguous):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Warn("container lookup failed", "error", err)
+	writeJSONError(w, http.StatusBadGateway, err.Error())
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// ============================================================
+// Container Control (POST /containers/{id}/{action})
+// ============================================================
+//
+// start/stop/restart act only on containers findContainer resolves, i.e.
+// ones discoverContainers reports, and never on conduit-expose itself.
+// Each container has a cooldown between actions, stop can require a second
+// request carrying a short-lived confirmation code, and every request is
+// written to <data dir>/audit.jsonl.
+
+const (
+	actionStart   = "start"
+	actionStop    = "stop"
+	actionRestart = "restart"
+
+	controlStopGrace    = 10 // seconds Docker waits before killing on stop/restart
+	controlWriteTimeout = 60 * time.Second
+	auditLogFile        = "audit.jsonl"
+)
+
+// Audit results
+const (
+	auditOK              = "ok"
+	auditError           = "error"
+	auditNotFound        = "not_found"
+	auditRateLimited     = "rate_limited"
+	auditConfirmRequired = "confirm_required"
+	auditConfirmRejected = "confirm_rejected"
+)
+
+// Controller performs container actions and keeps per-container cooldown
+// and pending stop confirmations.
+type Controller struct {
+	cli       *client.Client
+	cfg       *Config
+	auditPath string
+
+	mu         sync.Mutex
+	lastAction map[string]time.Time      // by container ID
+	pending    map[string]pendingConfirm // by container ID
+
+	auditMu sync.Mutex
+}
+
+// pendingConfirm is an issued stop confirmation code. It is bound to the
+// token that requested it and can be used once.
+type pendingConfirm struct {
+	code    string
+	token   string
+	expires time.Time
+}
+
+// NewController creates a Controller that acts through cli.
+func NewController(cli *client.Client, cfg *Config) *Controller {
+	return &Controller{
+		cli:        cli,
+		cfg:        cfg,
+		auditPath:  filepath.Join(cfg.DataDir, auditLogFile),
+		lastAction: make(map[string]time.Time),
+		pending:    make(map[string]pendingConfirm),
+	}
+}
+
+// Handler returns the HTTP handler for one action. It expects to run behind
+// authMiddleware so the requesting token is known.
+func (c *Controller) Handler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("id")
+		entry := AuditEntry{
+			Time:       time.Now().Unix(),
+			RemoteAddr: clientIP(r).String(),
+			Action:     action,
+			Container:  ref,
+		}
+		if t := requestToken(r); t != nil {
+			entry.Token = t.Name
+		}
+
+		lookupCtx, cancel := context.WithTimeout(r.Context(), c.cfg.DockerTimeout)
+		ctr, err := findContainer(lookupCtx, c.cli, ref)
+		cancel()
+		if err != nil {
+			entry.Result = auditNotFound
+			if !errors.Is(err, errContainerNotFound) {
+				entry.Result = auditError
+			}
+			entry.Error = err.Error()
+			c.audit(entry)
+			writeContainerLookupError(w, err)
+			return
+		}
+		entry.Container = containerName(ctr)
+		entry.ContainerID = ctr.ID
+
+		resp := &ContainerActionResponse{
+			APIVersion: requestAPIVersion(r),
+			Action:     action,
+			Container:  entry.Container,
+			ID:         ctr.ID,
+		}
+
+		if wait := c.cooldownRemaining(ctr.ID, time.Now()); wait > 0 {
+			entry.Result = auditRateLimited
+			c.audit(entry)
+			writeRetryAfter(w, wait)
+			return
+		}
+
+		if action == actionStop && c.cfg.ControlConfirm > 0 {
+			code := r.URL.Query().Get("confirm")
+			if code == "" {
+				resp.Status = auditConfirmRequired
+				resp.Confirm, resp.ConfirmExpires = c.issueConfirm(ctr.ID, entry.Token)
+				entry.Result = auditConfirmRequired
+				c.audit(entry)
+				writeAPIJSON(w, r, http.StatusAccepted, resp)
+				return
+			}
+			if !c.useConfirm(ctr.ID, entry.Token, code, time.Now()) {
+				entry.Result = auditConfirmRejected
+				c.audit(entry)
+				writeJSONError(w, http.StatusConflict, "invalid or expired confirmation code")
+				return
+			}
+		}
+
+		if wait, ok := c.reserve(ctr.ID, time.Now()); !ok {
+			entry.Result = auditRateLimited
+			c.audit(entry)
+			writeRetryAfter(w, wait)
+			return
+		}
+
+		// stop/restart can take the whole grace period, which is longer than
+		// the server's default write timeout.
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+
+		ctx, cancel := context.WithTimeout(r.Context(), controlStopGrace*time.Second+c.cfg.DockerTimeout)
+		defer cancel()
+		if err := c.do(ctx, action, ctr.ID); err != nil {
+			entry.Result = auditError
+			entry.Error = err.Error()
+			c.audit(entry)
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("%s failed: %v", action, err))
+			return
+		}
+
+		entry.Result = auditOK
+		c.audit(entry)
+		resp.Status = auditOK
+		writeAPIJSON(w, r, http.StatusOK, resp)
+	}
+}
+
+func (c *Controller) do(ctx context.Context, action, id string) error {
+	grace := controlStopGrace
+	switch action {
+	case actionStart:
+		return c.cli.ContainerStart(ctx, id, container.StartOptions{})
+	case actionStop:
+		return c.cli.ContainerStop(ctx, id, container.StopOptions{Timeout: &grace})
+	case actionRestart:
+		return c.cli.ContainerRestart(ctx, id, container.StopOptions{Timeout: &grace})
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// cooldownRemaining returns how long until the container may be acted on again.
+func (c *Controller) cooldownRemaining(id string, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastAction[id].Add(c.cfg.ControlCooldown).Sub(now)
+}
+
+// reserve starts the container's cooldown, or reports how long is left if
+// another action got there first.
+func (c *Controller) reserve(id string, now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if wait := c.lastAction[id].Add(c.cfg.ControlCooldown).Sub(now); wait > 0 {
+		return wait, false
+	}
+	c.lastAction[id] = now
+	return 0, true
+}
+
+// issueConfirm creates a stop confirmation code for the container, replacing
+// any earlier one, and returns it with its expiry (Unix seconds).
+func (c *Controller) issueConfirm(id, token string) (string, int64) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	p := pendingConfirm{
+		code:    hex.EncodeToString(b),
+		token:   token,
+		expires: time.Now().Add(c.cfg.ControlConfirm),
+	}
+
+	c.mu.Lock()
+	c.pending[id] = p
+	c.mu.Unlock()
+	return p.code, p.expires.Unix()
+}
+
+// useConfirm consumes the pending code for the container if it matches, was
+// issued to the same token and hasn't expired.
+func (c *Controller) useConfirm(id, token, code string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[id]
+	if !ok || p.token != token || now.After(p.expires) {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(p.code)) != 1 {
+		return false
+	}
+	delete(c.pending, id)
+	return true
+}
+
+// audit logs the entry and appends it to the audit file. A failed write is
+// logged but doesn't fail the request.
+func (c *Controller) audit(e AuditEntry) {
+	attrs := []any{"action", e.Action, "container", e.Container, "token", e.Token, "ip", e.RemoteAddr, "result", e.Result}
+	if e.Error != "" {
+		attrs = append(attrs, "error", e.Error)
+	}
+	slog.Info("audit", attrs...)
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	c.auditMu.Lock()
+	defer c.auditMu.Unlock()
+	f, err := os.OpenFile(c.auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		slog.Warn("audit: cannot open audit log", "path", c.auditPath, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		slog.Warn("audit: cannot write audit log", "path", c.auditPath, "error", err)
+		return
+	}
+	f.Sync()
+}
+
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	secs := int(wait.Seconds() + 0.999)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeJSONError(w, http.StatusTooManyRequests, fmt.Sprintf("container is cooling down, retry in %ds", secs))
+}
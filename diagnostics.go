@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Collector self-diagnostics
+// ============================================================
+//
+// collectAll reports how long each stage took and whether it failed; the
+// poll loop reports every cycle. GET /debug/collector and /metrics expose
+// the result, so a slow Docker daemon or a stuck container shows up
+// without reading logs.
+
+// Stages of collectAll. The container_* stages run once per container.
+const (
+	stageSystem    = "system"
+	stageCMData    = "cm_data"
+	stageDiscovery = "discovery"
+	stageStats     = "container_stats"
+	stageInspect   = "container_inspect"
+	stageLogs      = "container_logs"
+	stageSnowflake = "snowflake"
+)
+
+var collectorStages = []string{stageSystem, stageCMData, stageDiscovery, stageStats, stageInspect, stageLogs, stageSnowflake}
+
+// pollDurationBuckets are the upper bounds, in seconds, of the poll
+// duration histogram.
+var pollDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// PollState records the outcome of every poll cycle.
+type PollState struct {
+	mu          sync.Mutex
+	lastAttempt time.Time
+	lastSuccess time.Time
+	lastErr     error
+}
+
+// Record stores the result of a poll that finished at t.
+func (p *PollState) Record(t time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastAttempt = t
+	p.lastErr = err
+	if err == nil {
+		p.lastSuccess = t
+	}
+}
+
+// Get returns the time of the last poll, of the last successful poll and
+// the last poll's error.
+func (p *PollState) Get() (lastAttempt, lastSuccess time.Time, lastErr error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastAttempt, p.lastSuccess, p.lastErr
+}
+
+// Diagnostics collects timings and errors of the poll loop.
+type Diagnostics struct {
+	Polls   PollState
+	Issues  IssueTracker
+	started time.Time
+
+	mu          sync.Mutex
+	pollStart   time.Time // zero when no poll is running
+	pollCount   int64
+	pollErrors  int64
+	pollLast    time.Duration
+	pollSum     time.Duration
+	pollBuckets []int64 // non-cumulative, one per pollDurationBuckets entry plus +Inf
+	stages      map[string]*stageRecord
+	containers  map[string]map[string]time.Duration // last completed poll
+	pending     map[string]map[string]time.Duration // poll in progress
+	prevCPU     time.Duration
+	prevCPUAt   time.Time
+	cpuPercent  float64
+}
+
+type stageRecord struct {
+	count       int64
+	errors      int64
+	last        time.Duration
+	total       time.Duration
+	max         time.Duration
+	lastErr     string
+	lastErrorAt time.Time
+}
+
+func NewDiagnostics() *Diagnostics {
+	d := &Diagnostics{
+		started:     time.Now(),
+		pollBuckets: make([]int64, len(pollDurationBuckets)+1),
+		stages:      make(map[string]*stageRecord, len(collectorStages)),
+	}
+	for _, s := range collectorStages {
+		d.stages[s] = &stageRecord{}
+	}
+	d.prevCPU, _ = readProcessUsage()
+	d.prevCPUAt = d.started
+	return d
+}
+
+// BeginPoll marks the start of a poll cycle.
+func (d *Diagnostics) BeginPoll(t time.Time) {
+	d.Issues.begin()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pollStart = t
+	d.pending = make(map[string]map[string]time.Duration)
+}
+
+// EndPoll records a finished poll cycle and samples the process CPU usage.
+func (d *Diagnostics) EndPoll(t time.Time, err error) {
+	d.Polls.Record(t, err)
+	d.Issues.end()
+	cpu, _ := readProcessUsage()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dur := t.Sub(d.pollStart)
+	d.pollCount++
+	if err != nil {
+		d.pollErrors++
+	}
+	d.pollLast = dur
+	d.pollSum += dur
+	i, _ := slices.BinarySearch(pollDurationBuckets, dur.Seconds())
+	d.pollBuckets[i]++
+
+	d.containers = d.pending
+	d.pending = nil
+	d.pollStart = time.Time{}
+
+	if elapsed := t.Sub(d.prevCPUAt); elapsed > 0 {
+		d.cpuPercent = math.Round(float64(cpu-d.prevCPU)/float64(elapsed)*100*100) / 100
+	}
+	d.prevCPU, d.prevCPUAt = cpu, t
+}
+
+// Observe records one run of a stage. container is "" for host-wide stages.
+func (d *Diagnostics) Observe(stage, container string, dur time.Duration, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.stages[stage]
+	s.count++
+	s.last = dur
+	s.total += dur
+	s.max = max(s.max, dur)
+	if err != nil {
+		s.errors++
+		s.lastErr = err.Error()
+		s.lastErrorAt = time.Now()
+	}
+
+	if container != "" && d.pending != nil {
+		if d.pending[container] == nil {
+			d.pending[container] = make(map[string]time.Duration, 3)
+		}
+		d.pending[container][stage] = dur
+	}
+}
+
+// Snapshot returns the current diagnostics. APIVersion and Guard are left
+// for the caller.
+func (d *Diagnostics) Snapshot() *CollectorDiagnostics {
+	now := time.Now()
+	lastAttempt, lastSuccess, lastErr := d.Polls.Get()
+	cpu, rss := readProcessUsage()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := &CollectorDiagnostics{
+		UptimeSeconds: math.Round(now.Sub(d.started).Seconds()),
+		Polls: PollDiagnostics{
+			Count:              d.pollCount,
+			Errors:             d.pollErrors,
+			LastDurationMs:     durationMs(d.pollLast),
+			DurationSumSeconds: d.pollSum.Seconds(),
+		},
+		Process: ProcessDiagnostics{
+			CPUPercent: d.cpuPercent,
+			CPUSeconds: cpu.Seconds(),
+			RSSMB:      math.Round(float64(rss)/bytesPerMB*100) / 100,
+			HeapMB:     math.Round(float64(ms.HeapAlloc)/bytesPerMB*100) / 100,
+			Goroutines: runtime.NumGoroutine(),
+			GCCycles:   ms.NumGC,
+		},
+	}
+	if !lastAttempt.IsZero() {
+		out.Polls.LastAt = lastAttempt.Unix()
+	}
+	if !lastSuccess.IsZero() {
+		out.Polls.LastSuccessAt = lastSuccess.Unix()
+	}
+	if lastErr != nil {
+		out.Polls.LastError = lastErr.Error()
+	}
+	if !d.pollStart.IsZero() {
+		out.Polls.RunningSeconds = math.Round(now.Sub(d.pollStart).Seconds()*10) / 10
+	}
+	var cumulative int64
+	for i, le := range pollDurationBuckets {
+		cumulative += d.pollBuckets[i]
+		out.Polls.Histogram = append(out.Polls.Histogram, HistogramBucket{LE: le, Count: cumulative})
+	}
+
+	for _, name := range collectorStages {
+		s := d.stages[name]
+		sd := StageDiagnostics{
+			Stage:     name,
+			Count:     s.count,
+			Errors:    s.errors,
+			LastMs:    durationMs(s.last),
+			MaxMs:     durationMs(s.max),
+			LastError: s.lastErr,
+		}
+		if s.count > 0 {
+			sd.AvgMs = durationMs(s.total / time.Duration(s.count))
+		}
+		if !s.lastErrorAt.IsZero() {
+			sd.LastErrorAt = s.lastErrorAt.Unix()
+		}
+		out.Stages = append(out.Stages, sd)
+	}
+
+	out.Containers = make([]ContainerTimings, 0, len(d.containers))
+	for name, stages := range d.containers {
+		ct := ContainerTimings{Name: name, StagesMs: make(map[string]float64, len(stages))}
+		for s, dur := range stages {
+			ct.StagesMs[s] = durationMs(dur)
+		}
+		out.Containers = append(out.Containers, ct)
+	}
+	slices.SortFunc(out.Containers, func(a, b ContainerTimings) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return out
+}
+
+func durationMs(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+}
+
+// diagnosticsHandler serves GET /debug/collector.
+func diagnosticsHandler(diag *Diagnostics, guard *Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out := diag.Snapshot()
+		out.APIVersion = requestAPIVersion(r)
+		out.Guard = guard.Stats()
+		writeAPIJSON(w, r, http.StatusOK, out)
+	}
+}
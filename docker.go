@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"os"
 	"strings"
@@ -76,9 +78,73 @@ func containerName(c types.Container) string {
 	return ""
 }
 
+// findContainer resolves a container reference (name, full ID or unique ID
+// prefix) among the containers discoverContainers would report.
+// Returns errContainerNotFound if nothing matches.
+func findContainer(ctx context.Context, cli *client.Client, ref string) (types.Container, error) {
+	ref = strings.TrimPrefix(ref, "/")
+	if ref == "" {
+		return types.Container{}, errContainerNotFound
+	}
+
+	containers, err := discoverContainers(ctx, cli)
+	if err != nil {
+		return types.Container{}, err
+	}
+
+	// Exact name wins over an ID prefix
+	for _, c := range containers {
+		if containerName(c) == ref {
+			return c, nil
+		}
+	}
+
+	if len(ref) < minContainerIDPrefix {
+		return types.Container{}, errContainerNotFound
+	}
+	var match *types.Container
+	for i, c := range containers {
+		if strings.HasPrefix(c.ID, ref) {
+			if match != nil {
+				return types.Container{}, fmt.Errorf("%w: %q", errContainerAmbiguous, ref)
+			}
+			match = &containers[i]
+		}
+	}
+	if match == nil {
+		return types.Container{}, errContainerNotFound
+	}
+	return *match, nil
+}
+
+// minContainerIDPrefix is the shortest ID prefix findContainer accepts,
+// so that a stray character can't select an arbitrary container.
+const minContainerIDPrefix = 4
+
+var (
+	errContainerNotFound  = errors.New("container not found")
+	errContainerAmbiguous = errors.New("ambiguous container reference")
+)
+
 // fetchAppMetricsFromLogs reads a container's recent logs via the Docker API,
 // finds the last [STATS] line, and parses it for app-level metrics.
 func fetchAppMetricsFromLogs(ctx context.Context, cli *client.Client, containerID string, cfg *Config) (*AppMetrics, error) {
+	lastStatsLine, err := fetchLastStatsLine(ctx, cli, containerID, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastStatsLine == "" {
+		return nil, nil
+	}
+
+	metrics := parseStatsLine(lastStatsLine)
+	return metrics, nil
+}
+
+// fetchLastStatsLine returns the most recent raw [STATS] line from a
+// container's logs, or "" if none of the recent lines contain one.
+func fetchLastStatsLine(ctx context.Context, cli *client.Client, containerID string, cfg *Config) (string, error) {
 	logsCtx, cancel := context.WithTimeout(ctx, cfg.DockerTimeout)
 	defer cancel()
 
@@ -88,45 +154,81 @@ func fetchAppMetricsFromLogs(ctx context.Context, cli *client.Client, containerI
 		Tail:       "200",
 	})
 	if err != nil {
-		return nil, fmt.Errorf("reading container logs: %w", err)
+		return "", fmt.Errorf("reading container logs: %w", err)
 	}
 	defer reader.Close()
 
-	// Docker multiplexed stream has 8-byte header per frame.
-	// Read all content, stripping headers.
+	// A read error (e.g. the timeout) just ends the scan; whatever was
+	// read so far is still used.
 	var lastStatsLine string
-	br := bufio.NewReader(reader)
+	readLogLines(reader, func(_, line string) error {
+		if strings.Contains(line, "[STATS]") {
+			lastStatsLine = line
+		}
+		return nil
+	})
+
+	return strings.TrimSpace(lastStatsLine), nil
+}
+
+// maxLogLineBytes bounds a single log line; longer lines are split.
+const maxLogLineBytes = 64 * 1024
+
+// dockerLogStreams names the stream types of Docker's multiplexed log format.
+var dockerLogStreams = [...]string{0: "stdin", 1: "stdout", 2: "stderr"}
+
+// readLogLines demultiplexes a Docker log stream and calls fn with the stream
+// name and text of every line, without the trailing newline. Each frame has
+// an 8-byte header, [stream_type(1), 0, 0, 0, size(4)]; a line split across
+// frames is joined. An error from fn stops reading and is returned.
+func readLogLines(r io.Reader, fn func(stream, line string) error) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, 8)
+	var partial [len(dockerLogStreams)][]byte
+
 	for {
-		// Read 8-byte header: [stream_type(1), 0, 0, 0, size(4)]
-		header := make([]byte, 8)
-		_, err := io.ReadFull(br, header)
-		if err != nil {
-			break
+		if _, err := io.ReadFull(br, header); err != nil {
+			for s, rest := range partial {
+				if len(rest) > 0 {
+					if err := fn(dockerLogStreams[s], string(rest)); err != nil {
+						return err
+					}
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
 		}
 		frameSize := int(header[4])<<24 | int(header[5])<<16 | int(header[6])<<8 | int(header[7])
 		if frameSize <= 0 {
 			continue
 		}
 		frame := make([]byte, frameSize)
-		_, err = io.ReadFull(br, frame)
-		if err != nil {
-			break
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return err
 		}
 
-		// Frame may contain multiple lines
-		for _, line := range strings.Split(string(frame), "\n") {
-			if strings.Contains(line, "[STATS]") {
-				lastStatsLine = line
+		s := int(header[0])
+		if s >= len(dockerLogStreams) {
+			s = 1
+		}
+		data := append(partial[s], frame...)
+		for {
+			var line []byte
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line, data = data[:i], data[i+1:]
+			} else if len(data) >= maxLogLineBytes {
+				line, data = data[:maxLogLineBytes], data[maxLogLineBytes:]
+			} else {
+				break
+			}
+			if err := fn(dockerLogStreams[s], string(line)); err != nil {
+				return err
 			}
 		}
+		partial[s] = bytes.Clone(data)
 	}
-
-	if lastStatsLine == "" {
-		return nil, nil
-	}
-
-	metrics := parseStatsLine(lastStatsLine)
-	return metrics, nil
 }
 
 // containerUptimeSeconds computes seconds since container started from inspect data.
@@ -141,8 +243,9 @@ func containerUptimeSeconds(inspect types.ContainerJSON) float64 {
 	return time.Since(started).Seconds()
 }
 
-// collectContainerStats gathers Docker stats for a single container.
-func collectContainerStats(ctx context.Context, cli *client.Client, ctr types.Container, cfg *Config) ContainerInfo {
+// collectContainerStats gathers Docker stats for a single container. On
+// error the container is marked unhealthy and the error is returned with it.
+func collectContainerStats(ctx context.Context, cli *client.Client, ctr types.Container, cfg *Config) (ContainerInfo, error) {
 	name := containerName(ctr)
 
 	info := ContainerInfo{
@@ -154,7 +257,7 @@ func collectContainerStats(ctx context.Context, cli *client.Client, ctr types.Co
 
 	if ctr.State != "running" {
 		info.Status = "down"
-		return info
+		return info, nil
 	}
 
 	info.Uptime = time.Since(time.Unix(ctr.Created, 0)).Truncate(time.Second).String()
@@ -164,17 +267,17 @@ func collectContainerStats(ctx context.Context, cli *client.Client, ctr types.Co
 
 	statsResp, err := cli.ContainerStats(statsCtx, ctr.ID, false)
 	if err != nil {
-		log.Printf("WARN: failed to get stats for %s: %v", name, err)
+		slog.Warn("failed to get container stats", "container", name, "stage", stageStats, "error", err)
 		info.Status = "unhealthy"
-		return info
+		return info, err
 	}
 	defer statsResp.Body.Close()
 
 	var stats container.StatsResponse
 	if err := json.NewDecoder(statsResp.Body).Decode(&stats); err != nil {
-		log.Printf("WARN: failed to decode stats for %s: %v", name, err)
+		slog.Warn("failed to decode container stats", "container", name, "stage", stageStats, "error", err)
 		info.Status = "unhealthy"
-		return info
+		return info, err
 	}
 
 	// CPU percentage calculation
@@ -194,7 +297,7 @@ func collectContainerStats(ctx context.Context, cli *client.Client, ctr types.Co
 	// Memory in MB
 	info.MemoryMB = math.Round(float64(stats.MemoryStats.Usage)/1024/1024*100) / 100
 
-	return info
+	return info, nil
 }
 
 // collectContainerHealth extracts health indicators from a Docker inspect result
@@ -248,3 +351,53 @@ func extractAutoStart(inspect types.ContainerJSON) bool {
 	return policy == "always" || policy == "unless-stopped"
 }
 
+
+// collectContainerInspectInfo extracts extended inspect data for the
+// container detail endpoint. The image digest needs an extra image inspect
+// call; failures there only leave ImageDigest empty.
+func collectContainerInspectInfo(ctx context.Context, cli *client.Client, inspect types.ContainerJSON, cfg *Config) *ContainerInspectInfo {
+	info := &ContainerInspectInfo{
+		ImageID: inspect.Image,
+		Mounts:  make([]ContainerMount, 0, len(inspect.Mounts)),
+	}
+
+	if inspect.Config != nil {
+		info.Image = inspect.Config.Image
+	}
+
+	if inspect.State != nil {
+		info.StartedAt = inspect.State.StartedAt
+		info.FinishedAt = inspect.State.FinishedAt
+		info.ExitCode = inspect.State.ExitCode
+		info.PID = inspect.State.Pid
+	}
+
+	if inspect.HostConfig != nil {
+		hc := inspect.HostConfig
+		info.RestartPolicy = string(hc.RestartPolicy.Name)
+		info.NetworkMode = string(hc.NetworkMode)
+		info.Limits.MemoryBytes = hc.Memory
+		info.Limits.CPUs = float64(hc.NanoCPUs) / 1e9
+		info.Limits.CPUShares = hc.CPUShares
+		if hc.PidsLimit != nil {
+			info.Limits.PidsLimit = *hc.PidsLimit
+		}
+	}
+
+	for _, m := range inspect.Mounts {
+		info.Mounts = append(info.Mounts, ContainerMount{
+			Type:        string(m.Type),
+			Source:      m.Source,
+			Destination: m.Destination,
+			ReadOnly:    !m.RW,
+		})
+	}
+
+	imageCtx, cancel := context.WithTimeout(ctx, cfg.DockerTimeout)
+	defer cancel()
+	if image, _, err := cli.ImageInspectWithRaw(imageCtx, inspect.Image); err == nil && len(image.RepoDigests) > 0 {
+		info.ImageDigest = image.RepoDigests[0]
+	}
+
+	return info
+}
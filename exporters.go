@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================
+// InfluxDB and StatsD exporters (CONDUIT_INFLUX_URL, CONDUIT_STATSD_ADDR)
+// ============================================================
+//
+// After every poll, the StatusResponse is flattened into points (a
+// measurement with tags and numeric fields, see exportPoints) and written
+// as InfluxDB line protocol over HTTP or UDP, and/or as StatsD gauges and
+// counters over UDP. Exporting runs in its own goroutine; if a write is
+// still in progress when the next poll finishes, only the newest result is
+// kept. A failed write is logged and not retried, like a missed scrape.
+//
+// Values the containers report as running totals (traffic, restarts,
+// snowflake counters) are counters. InfluxDB gets them as they are; StatsD
+// gets the increase since the previous poll, as its counters expect.
+
+const (
+	defaultExportPrefix = "conduit"
+	exportTimeout       = 10 * time.Second
+	// exportUDPPayload keeps datagrams under a typical MTU.
+	exportUDPPayload = 1432
+)
+
+// exportPoint is one measurement of a poll result.
+type exportPoint struct {
+	measurement string   // appended to the prefix; "" for the top level
+	tags        []string // name/value pairs, besides server_id and CONDUIT_EXPORT_TAGS
+	fields      []exportField
+}
+
+type exportField struct {
+	name    string
+	value   float64
+	counter bool
+}
+
+// exportPoints flattens resp. If containers couldn't be listed, only host
+// data is included rather than client counts of zero.
+func exportPoints(resp *StatusResponse) []exportPoint {
+	var points []exportPoint
+	add := func(measurement string, tags []string, fields ...exportField) {
+		points = append(points, exportPoint{measurement, tags, fields})
+	}
+	gauge := func(name string, v float64) exportField { return exportField{name, v, false} }
+	counter := func(name string, v float64) exportField { return exportField{name, v, true} }
+
+	failed := slices.ContainsFunc(resp.Warnings, func(w StatusIssue) bool { return w.Code == issueDiscoveryFailed })
+	if failed {
+		add("", nil, gauge("cm_available", boolToFloat(resp.CMAvailable)))
+	} else {
+		add("", nil,
+			gauge("containers", float64(resp.TotalContainers)),
+			gauge("connected_clients", float64(resp.ConnectedClients)),
+			gauge("connecting_clients", float64(resp.ConnectingClients)),
+			gauge("cm_available", boolToFloat(resp.CMAvailable)),
+		)
+	}
+
+	if s := resp.System; s != nil {
+		add("system", nil,
+			gauge("cpu_percent", s.CPUPercent),
+			gauge("memory_used_mb", s.MemoryUsedMB),
+			gauge("memory_total_mb", s.MemoryTotalMB),
+			gauge("load_avg_1m", s.LoadAvg1m),
+			gauge("load_avg_5m", s.LoadAvg5m),
+			gauge("load_avg_15m", s.LoadAvg15m),
+			gauge("disk_used_gb", s.DiskUsedGB),
+			gauge("disk_total_gb", s.DiskTotalGB),
+			gauge("net_in_mbps", s.NetInMbps),
+			gauge("net_out_mbps", s.NetOutMbps),
+			gauge("net_errors", float64(s.NetErrors)),
+			gauge("net_drops", float64(s.NetDrops)),
+		)
+	}
+	if failed {
+		return points
+	}
+
+	if s := resp.Session; s != nil {
+		add("session", nil,
+			gauge("peak_connections", float64(s.PeakConnections)),
+			gauge("avg_connections", s.AvgConnections),
+			counter("upload_bytes", s.TotalUploadBytes),
+			counter("download_bytes", s.TotalDownloadBytes),
+		)
+	}
+	if c := resp.Connections; c != nil {
+		add("connections", nil, gauge("total", float64(c.Total)), gauge("unique_ips", float64(c.UniqueIPs)))
+		for _, state := range slices.Sorted(maps.Keys(c.States)) {
+			add("connections_state", []string{"state", state}, gauge("count", float64(c.States[state])))
+		}
+	}
+
+	for _, c := range resp.Containers {
+		fields := []exportField{
+			gauge("running", boolToFloat(c.Status == "running")),
+			gauge("cpu_percent", c.CPUPercent),
+			gauge("memory_mb", c.MemoryMB),
+		}
+		if m := c.AppMetrics; m != nil {
+			fields = append(fields,
+				gauge("connected_clients", float64(m.ConnectedClients)),
+				gauge("connecting_clients", float64(m.ConnectingClients)),
+				gauge("announcing", float64(m.Announcing)),
+				gauge("live", boolToFloat(m.IsLive)),
+				counter("uploaded_bytes", m.BytesUploaded),
+				counter("downloaded_bytes", m.BytesDownloaded),
+				gauge("uptime_seconds", m.UptimeSeconds),
+				gauge("idle_seconds", m.IdleSeconds),
+			)
+		}
+		if h := c.Health; h != nil {
+			fields = append(fields,
+				counter("restarts", float64(h.RestartCount)),
+				gauge("oom_killed", boolToFloat(h.OOMKilled)),
+				gauge("open_fds", float64(h.FDCount)),
+				gauge("threads", float64(h.ThreadCount)),
+			)
+		}
+		add("container", []string{"container", c.Name}, fields...)
+	}
+
+	if s := resp.Snowflake; s != nil {
+		add("snowflake", nil,
+			counter("connections", float64(s.TotalConnections)),
+			counter("timeouts", float64(s.TimeoutsTotal)),
+			counter("inbound_bytes", s.InboundBytes),
+			counter("outbound_bytes", s.OutboundBytes),
+		)
+	}
+
+	// One point per country, with whichever of the two sources has it
+	byCountry := make(map[string][]exportField)
+	for _, cs := range resp.ClientsByCountry {
+		byCountry[cs.Country] = append(byCountry[cs.Country], gauge("clients", float64(cs.Connections)))
+	}
+	for _, ct := range resp.TrafficByCountry {
+		byCountry[ct.Country] = append(byCountry[ct.Country], counter("from_bytes", ct.FromBytes), counter("to_bytes", ct.ToBytes))
+	}
+	for _, country := range slices.Sorted(maps.Keys(byCountry)) {
+		add("country", []string{"country", country}, byCountry[country]...)
+	}
+	return points
+}
+
+// Exporters writes poll results to the configured InfluxDB and StatsD
+// endpoints.
+type Exporters struct {
+	influx *influxExporter
+	statsd *statsdExporter
+	latest chan *StatusResponse
+}
+
+// NewExporters returns the configured exporters, or nil if neither
+// CONDUIT_INFLUX_URL nor CONDUIT_STATSD_ADDR is set.
+func NewExporters(cfg *Config) (*Exporters, error) {
+	if cfg.InfluxURL == "" && cfg.StatsDAddr == "" {
+		return nil, nil
+	}
+	tags, err := parseExportTags(cfg.ExportTags)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Exporters{latest: make(chan *StatusResponse, 1)}
+	if cfg.InfluxURL != "" {
+		if e.influx, err = newInfluxExporter(cfg, tags); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.StatsDAddr != "" {
+		if e.statsd, err = newStatsDExporter(cfg, tags); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// parseExportTags parses CONDUIT_EXPORT_TAGS, "name=value,name=value".
+func parseExportTags(s string) ([]string, error) {
+	var tags []string
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("CONDUIT_EXPORT_TAGS: %q is not name=value", kv)
+		}
+		if k == "server_id" || k == "container" || k == "country" || k == "state" {
+			return nil, fmt.Errorf("CONDUIT_EXPORT_TAGS: %q is a built-in tag", k)
+		}
+		tags = append(tags, k, v)
+	}
+	return tags, nil
+}
+
+// Add hands resp to the export goroutine, replacing a result that is still
+// waiting. It is meant to be passed to pollLoop as a hook.
+func (e *Exporters) Add(resp *StatusResponse) {
+	for {
+		select {
+		case e.latest <- resp:
+			return
+		default:
+		}
+		select {
+		case <-e.latest:
+		default:
+		}
+	}
+}
+
+// Run exports results passed to Add until ctx is done.
+func (e *Exporters) Run(ctx context.Context) {
+	if e.influx != nil {
+		slog.Info("influx export enabled", "url", e.influx.label)
+	}
+	if e.statsd != nil {
+		slog.Info("statsd export enabled", "addr", e.statsd.addr)
+	}
+	go func() {
+		for {
+			select {
+			case resp := <-e.latest:
+				points := exportPoints(resp)
+				if e.influx != nil {
+					if err := e.influx.write(ctx, resp, points); err != nil && ctx.Err() == nil {
+						slog.Warn("influx export failed", "url", e.influx.label, "error", err)
+					}
+				}
+				if e.statsd != nil {
+					if err := e.statsd.write(ctx, resp, points); err != nil && ctx.Err() == nil {
+						slog.Warn("statsd export failed", "addr", e.statsd.addr, "error", err)
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sendDatagrams writes lines to a UDP address, as many whole lines per
+// datagram as fit in exportUDPPayload.
+func sendDatagrams(ctx context.Context, addr string, lines [][]byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(exportTimeout))
+
+	var buf []byte
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		_, err := conn.Write(bytes.TrimSuffix(buf, []byte("\n")))
+		buf = buf[:0]
+		return err
+	}
+	for _, line := range lines {
+		if len(buf)+len(line) > exportUDPPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		buf = append(buf, line...)
+	}
+	return flush()
+}
+
+// ============================================================
+// InfluxDB line protocol
+// ============================================================
+
+type influxExporter struct {
+	url    *url.URL // http(s)://... write endpoint or udp://host:port
+	label  string   // URL without credentials, for logs
+	token  string
+	prefix string
+	tags   []string
+	client *http.Client
+}
+
+func newInfluxExporter(cfg *Config, tags []string) (*influxExporter, error) {
+	u, err := url.Parse(cfg.InfluxURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") {
+		return nil, fmt.Errorf("CONDUIT_INFLUX_URL must be an http://, https:// or udp:// URL, got %q", cfg.InfluxURL)
+	}
+	return &influxExporter{
+		url:    u,
+		label:  u.Scheme + "://" + u.Host,
+		token:  cfg.InfluxToken,
+		prefix: cfg.InfluxPrefix,
+		tags:   tags,
+		client: &http.Client{Timeout: exportTimeout},
+	}, nil
+}
+
+func (x *influxExporter) write(ctx context.Context, resp *StatusResponse, points []exportPoint) error {
+	ts := strconv.FormatInt(resp.Timestamp*int64(time.Second), 10)
+	lines := make([][]byte, 0, len(points))
+	for _, p := range points {
+		lines = append(lines, x.line(p, resp.ServerID, ts))
+	}
+
+	if x.url.Scheme == "udp" {
+		return sendDatagrams(ctx, x.url.Host, lines)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, x.url.String(), bytes.NewReader(bytes.Join(lines, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", userAgent)
+	if x.token != "" {
+		req.Header.Set("Authorization", "Token "+x.token)
+	}
+	res, err := x.client.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			return ue.Err // the URL may carry credentials
+		}
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d: %s", res.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// line renders p with a nanosecond timestamp, so it is read correctly
+// whatever precision the endpoint defaults to.
+func (x *influxExporter) line(p exportPoint, serverID, ts string) []byte {
+	var b bytes.Buffer
+	name := x.prefix
+	if p.measurement != "" {
+		name += "_" + p.measurement
+	}
+	b.WriteString(influxEscape(name, ", "))
+
+	tags := append([]string{"server_id", serverID}, p.tags...)
+	tags = append(tags, x.tags...)
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] == "" {
+			continue // empty tag values are invalid
+		}
+		b.WriteByte(',')
+		b.WriteString(influxEscape(tags[i], ",= "))
+		b.WriteByte('=')
+		b.WriteString(influxEscape(tags[i+1], ",= "))
+	}
+
+	for i, f := range p.fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxEscape(f.name, ",= "))
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(f.value, 'g', -1, 64))
+	}
+	b.WriteByte(' ')
+	b.WriteString(ts)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// influxEscape backslash-escapes backslashes and the characters in
+// special. Newlines can't be escaped and become spaces.
+func influxEscape(s, special string) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ============================================================
+// StatsD / DogStatsD
+// ============================================================
+
+type statsdExporter struct {
+	addr   string
+	prefix string
+	tags   []string
+	dog    bool // DogStatsD tags instead of tag values in the name
+
+	prev map[string]float64 // counter values of the previous poll
+}
+
+func newStatsDExporter(cfg *Config, tags []string) (*statsdExporter, error) {
+	if _, _, err := net.SplitHostPort(cfg.StatsDAddr); err != nil {
+		return nil, fmt.Errorf("CONDUIT_STATSD_ADDR must be host:port, got %q", cfg.StatsDAddr)
+	}
+	return &statsdExporter{
+		addr:   cfg.StatsDAddr,
+		prefix: cfg.StatsDPrefix,
+		tags:   tags,
+		dog:    cfg.DogStatsD,
+		prev:   make(map[string]float64),
+	}, nil
+}
+
+// write sends gauges as they are and counters as the increase since the
+// previous poll; a counter seen for the first time is sent from the next
+// poll on, and one that went down (the container restarted) is sent whole.
+// Plain StatsD has no tags, so tag values become part of the name:
+// <prefix>.container.<name>.cpu_percent. server_id and CONDUIT_EXPORT_TAGS
+// are only sent as DogStatsD tags.
+func (x *statsdExporter) write(ctx context.Context, resp *StatusResponse, points []exportPoint) error {
+	var lines [][]byte
+	seen := make(map[string]float64)
+	for _, p := range points {
+		name := x.prefix
+		if p.measurement != "" {
+			name += "." + p.measurement
+		}
+		var suffix string
+		if x.dog {
+			tags := append([]string{"server_id", resp.ServerID}, p.tags...)
+			tags = append(tags, x.tags...)
+			var ts []string
+			for i := 0; i+1 < len(tags); i += 2 {
+				ts = append(ts, statsdTagSanitize(tags[i])+":"+statsdTagSanitize(tags[i+1]))
+			}
+			suffix = "|#" + strings.Join(ts, ",")
+		} else {
+			for i := 1; i < len(p.tags); i += 2 {
+				name += "." + statsdSanitize(p.tags[i])
+			}
+		}
+
+		for _, f := range p.fields {
+			metric := name + "." + f.name
+			value, typ := f.value, "g"
+			if f.counter {
+				key := metric + suffix
+				seen[key] = f.value
+				last, ok := x.prev[key]
+				if !ok {
+					continue
+				}
+				if value >= last {
+					value -= last
+				}
+				typ = "c"
+			}
+			// A gauge with a sign is an adjustment in StatsD.
+			value = max(value, 0)
+			lines = append(lines, []byte(metric+":"+strconv.FormatFloat(value, 'g', -1, 64)+"|"+typ+suffix+"\n"))
+		}
+	}
+	x.prev = seen
+	return sendDatagrams(ctx, x.addr, lines)
+}
+
+// statsdSanitize replaces characters that separate names, values and types.
+var statsdSanitize = strings.NewReplacer(
+	".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_", "/", "_",
+).Replace
+
+var statsdTagSanitize = strings.NewReplacer("|", "_", ",", "_", "#", "_", " ", "_", "\n", "_").Replace
@@ -3,7 +3,9 @@ module conduit-expose
 go 1.24.0
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/docker/docker v27.5.1+incompatible
+	github.com/klauspost/compress v1.18.0
 	github.com/phuslu/iploc v1.0.20260201
 )
 
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Sample flattening
+// ============================================================
+
+// historySampleFromStatus flattens a StatusResponse into named series.
+// Names are dot-separated: top-level values ("connected_clients"),
+// per-container values ("container.conduit-1.cpu_percent") and per-country
+// values ("country.IR.clients").
+func historySampleFromStatus(resp *StatusResponse) HistorySample {
+	v := map[string]float64{
+		"connected_clients":  float64(resp.ConnectedClients),
+		"connecting_clients": float64(resp.ConnectingClients),
+	}
+
+	if s := resp.System; s != nil {
+		v["cpu_percent"] = s.CPUPercent
+		v["memory_used_mb"] = s.MemoryUsedMB
+		v["net_in_mbps"] = s.NetInMbps
+		v["net_out_mbps"] = s.NetOutMbps
+	}
+
+	if s := resp.Session; s != nil {
+		v["upload_bytes"] = s.TotalUploadBytes
+		v["download_bytes"] = s.TotalDownloadBytes
+	}
+
+	for _, c := range resp.Containers {
+		prefix := "container." + c.Name + "."
+		v[prefix+"cpu_percent"] = c.CPUPercent
+		v[prefix+"memory_mb"] = c.MemoryMB
+		if m := c.AppMetrics; m != nil {
+			v[prefix+"connected_clients"] = float64(m.ConnectedClients)
+			v[prefix+"connecting_clients"] = float64(m.ConnectingClients)
+			v[prefix+"upload_bytes"] = m.BytesUploaded
+			v[prefix+"download_bytes"] = m.BytesDownloaded
+		}
+	}
+
+	for _, cs := range resp.ClientsByCountry {
+		v["country."+cs.Country+".clients"] = float64(cs.Connections)
+	}
+
+	return HistorySample{Timestamp: resp.Timestamp, Values: v}
+}
+
+// ============================================================
+// In-memory ring buffer
+// ============================================================
+
+// History keeps every poll result for a fixed retention window in a ring
+// buffer sized from the retention and poll interval.
+type History struct {
+	mu        sync.RWMutex
+	samples   []HistorySample
+	start     int // index of the oldest sample
+	count     int
+	retention time.Duration
+}
+
+// NewHistory creates a history buffer large enough to hold retention worth
+// of samples taken every pollInterval.
+func NewHistory(retention, pollInterval time.Duration) *History {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	capacity := int(retention/pollInterval) + 1
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &History{
+		samples:   make([]HistorySample, capacity),
+		retention: retention,
+	}
+}
+
+// Add records a poll result. It is meant to be passed to pollLoop as a hook.
+func (h *History) Add(resp *StatusResponse) {
+	h.AddSample(historySampleFromStatus(resp))
+}
+
+// AddSample appends a sample, overwriting the oldest one when full and
+// dropping samples older than the retention window.
+func (h *History) AddSample(s HistorySample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	capacity := len(h.samples)
+	if h.count < capacity {
+		h.samples[(h.start+h.count)%capacity] = s
+		h.count++
+	} else {
+		h.samples[h.start] = s
+		h.start = (h.start + 1) % capacity
+	}
+
+	cutoff := s.Timestamp - int64(h.retention.Seconds())
+	for h.count > 0 && h.samples[h.start].Timestamp < cutoff {
+		h.samples[h.start] = HistorySample{}
+		h.start = (h.start + 1) % capacity
+		h.count--
+	}
+}
+
+// Oldest returns the timestamp of the oldest retained sample, or 0 if empty.
+func (h *History) Oldest() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.samples[h.start].Timestamp
+}
+
+// Range returns the samples with from <= timestamp <= to, oldest first.
+func (h *History) Range(from, to int64) []HistorySample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var out []HistorySample
+	capacity := len(h.samples)
+	for i := 0; i < h.count; i++ {
+		s := h.samples[(h.start+i)%capacity]
+		if s.Timestamp >= from && s.Timestamp <= to {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// ============================================================
+// Downsampling
+// ============================================================
+
+// downsample groups samples into step-sized buckets (aligned to Unix time)
+// and computes min/max/avg per bucket for every series matched by patterns.
+// Patterns use path.Match syntax, e.g. "container.*.cpu_percent"; an empty
+// pattern list matches every series.
+func downsample(samples []HistorySample, step int64, patterns []string) map[string][]HistoryPoint {
+	type acc struct {
+		min, max, sum float64
+		n             int
+	}
+
+	buckets := make(map[string]map[int64]*acc)
+	matched := make(map[string]bool)
+
+	for _, s := range samples {
+		bucket := s.Timestamp - s.Timestamp%step
+		for name, val := range s.Values {
+			ok, seen := matched[name]
+			if !seen {
+				ok = matchSeries(name, patterns)
+				matched[name] = ok
+			}
+			if !ok {
+				continue
+			}
+
+			lo, hi := val, val
+			if m, has := s.Min[name]; has {
+				lo = m
+			}
+			if m, has := s.Max[name]; has {
+				hi = m
+			}
+
+			series := buckets[name]
+			if series == nil {
+				series = make(map[int64]*acc)
+				buckets[name] = series
+			}
+			a := series[bucket]
+			if a == nil {
+				a = &acc{min: math.Inf(1), max: math.Inf(-1)}
+				series[bucket] = a
+			}
+			a.min = math.Min(a.min, lo)
+			a.max = math.Max(a.max, hi)
+			a.sum += val
+			a.n++
+		}
+	}
+
+	out := make(map[string][]HistoryPoint, len(buckets))
+	for name, series := range buckets {
+		points := make([]HistoryPoint, 0, len(series))
+		for t, a := range series {
+			points = append(points, HistoryPoint{
+				Timestamp: t,
+				Min:       a.min,
+				Max:       a.max,
+				Avg:       a.sum / float64(a.n),
+				Count:     a.n,
+			})
+		}
+		sort.Slice(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+		out[name] = points
+	}
+	return out
+}
+
+func matchSeries(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================
+// HTTP Handler (GET /history)
+// ============================================================
+
+const (
+	defaultHistoryWindow = time.Hour
+	historyTargetPoints  = 300   // default step aims for about this many buckets
+	historyMaxPoints     = 10000 // step is raised so no series exceeds this
+)
+
+// historyHandler serves GET /history?from=&to=&step=&series=.
+// from/to are Unix seconds (default: the last hour), step is a Go duration
+// or a number of seconds, series is a comma-separated list of patterns.
+// Ranges reaching further back than the in-memory buffer are read from the
+// on-disk store when one is configured (store may be nil).
+func historyHandler(history *History, store *Store, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		now := time.Now().Unix()
+
+		to, err := parseUnixParam(q.Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid 'to': "+err.Error())
+			return
+		}
+		from, err := parseUnixParam(q.Get("from"), to-int64(defaultHistoryWindow.Seconds()))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid 'from': "+err.Error())
+			return
+		}
+		if from > to {
+			writeJSONError(w, http.StatusBadRequest, "'from' must not be after 'to'")
+			return
+		}
+
+		step, err := parseStepParam(q.Get("step"), from, to, cfg.PollInterval)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid 'step': "+err.Error())
+			return
+		}
+
+		var patterns []string
+		for _, p := range strings.Split(q.Get("series"), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				patterns = append(patterns, p)
+			}
+		}
+
+		var samples []HistorySample
+		if oldest := history.Oldest(); store != nil && (oldest == 0 || from < oldest) {
+			samples = store.Range(from, to)
+		} else {
+			samples = history.Range(from, to)
+		}
+
+		resp := &HistoryResponse{
+			APIVersion: requestAPIVersion(r),
+			From:       from,
+			To:         to,
+			Step:       step,
+			Series:     downsample(samples, step, patterns),
+		}
+
+		writeAPIJSON(w, r, http.StatusOK, resp)
+	}
+}
+
+func parseUnixParam(v string, fallback int64) (int64, error) {
+	if v == "" {
+		return fallback, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// parseStepParam returns the bucket width in seconds. Without an explicit
+// step it targets historyTargetPoints buckets, never finer than the poll
+// interval; an explicit step is widened if it would exceed historyMaxPoints.
+func parseStepParam(v string, from, to int64, pollInterval time.Duration) (int64, error) {
+	span := to - from
+	minStep := int64(math.Max(1, pollInterval.Seconds()))
+
+	var step int64
+	if v == "" {
+		step = span / historyTargetPoints
+		if step < minStep {
+			step = minStep
+		}
+	} else {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			step = n
+		} else {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return 0, err
+			}
+			step = int64(d.Seconds())
+		}
+		if step < 1 {
+			step = 1
+		}
+	}
+
+	if span/step > historyMaxPoints {
+		step = span / historyMaxPoints
+	}
+	return step, nil
+}
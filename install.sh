@@ -75,6 +75,7 @@ confirm() {
 REPO_URL="https://github.com/omid3098/conduit_expose"
 CONFIG_DIR="/etc/conduit-expose"
 CONFIG_FILE="${CONFIG_DIR}/config"
+DATA_DIR="/var/lib/conduit-expose"
 CTL_PATH="/usr/local/bin/conduit-expose-ctl"
 CONTAINER_NAME="conduit-expose"
 IMAGE_NAME="conduit-expose"
@@ -213,11 +214,38 @@ do_install() {
         exit 1
     fi
 
+    # --- Secret path prefix ---
+    local path_prefix=""
+    if confirm "$(echo -e "${CYAN}Serve the API under a secret path prefix?${NC}")" "Y"; then
+        path_prefix="/$(generate_secret | cut -c1-16)"
+    fi
+
+    # --- TLS ---
+    local tls="false"
+    if confirm "$(echo -e "${CYAN}Enable TLS (self-signed, pinned in the URI)?${NC}")" "Y"; then
+        tls="true"
+    fi
+
+    # --- Push mode ---
+    local push_urls
+    prompt "$(echo -e "${CYAN}Push collector URL(s), comma-separated (optional)${NC}")" push_urls ""
+
+    # --- Tunnel ---
+    local tunnel_url listen_host=""
+    prompt "$(echo -e "${CYAN}Dashboard tunnel URL, ws:// or wss:// (optional)${NC}")" tunnel_url ""
+    if [ -n "$tunnel_url" ] && confirm "$(echo -e "${CYAN}Listen on loopback only (reachable through the tunnel only)?${NC}")" "N"; then
+        listen_host="127.0.0.1"
+    fi
+
     # --- Confirmation ---
     echo ""
     echo -e "${BOLD}Summary:${NC}"
     echo -e "  Port:    ${GREEN}${port}${NC}"
     echo -e "  Secret:  ${GREEN}${secret}${NC}"
+    echo -e "  TLS:     ${GREEN}${tls}${NC}"
+    echo -e "  Prefix:  ${GREEN}${path_prefix:-none}${NC}"
+    echo -e "  Push:    ${GREEN}${push_urls:-none}${NC}"
+    echo -e "  Tunnel:  ${GREEN}${tunnel_url:-none}${NC}"
     echo -e "  Image:   ${DIM}${IMAGE_NAME} (built locally)${NC}"
     echo ""
     if ! confirm "$(echo -e "${CYAN}Proceed with these settings?${NC}")" "Y"; then
@@ -249,6 +277,7 @@ do_install() {
 
     # --- Deploy container ---
     log_info "Starting container..."
+    mkdir -p "$DATA_DIR"
     docker run -d \
         --name "$CONTAINER_NAME" \
         --restart unless-stopped \
@@ -258,8 +287,13 @@ do_install() {
         -v /var/run/docker.sock:/var/run/docker.sock \
         -v /proc:/host/proc:ro \
         -v /:/host/root:ro \
+        -v "${DATA_DIR}:/var/lib/conduit-expose" \
         -e "CONDUIT_AUTH_SECRET=${secret}" \
-        -e "CONDUIT_LISTEN_ADDR=:${port}" \
+        -e "CONDUIT_LISTEN_ADDR=${listen_host}:${port}" \
+        -e "CONDUIT_TLS=${tls}" \
+        -e "CONDUIT_PATH_PREFIX=${path_prefix}" \
+        -e "CONDUIT_PUSH_URLS=${push_urls}" \
+        -e "CONDUIT_TUNNEL_URL=${tunnel_url}" \
         "$IMAGE_NAME" >/dev/null
 
     log_success "Container started"
@@ -267,13 +301,33 @@ do_install() {
     # --- Save config ---
     local server_ip
     server_ip=$(get_server_ip)
-    local connection_uri="conduit://${secret}@${server_ip}:${port}"
+    local connection_uri="conduit://${secret}@${server_ip}:${port}${path_prefix}"
+
+    # The agent writes its certificate fingerprint on startup; pin it in the URI
+    if [ "$tls" = "true" ]; then
+        local fingerprint="" _
+        for _ in $(seq 1 30); do
+            [ -s "${DATA_DIR}/tls/fingerprint" ] && break
+            sleep 1
+        done
+        fingerprint=$(cat "${DATA_DIR}/tls/fingerprint" 2>/dev/null || true)
+        if [ -n "$fingerprint" ]; then
+            connection_uri="${connection_uri}?fp=${fingerprint}"
+        else
+            log_warn "Certificate fingerprint not found; check 'docker logs ${CONTAINER_NAME}'"
+        fi
+    fi
 
     mkdir -p "$CONFIG_DIR"
     cat > "$CONFIG_FILE" <<CONF
 PORT=${port}
 AUTH_SECRET=${secret}
 SERVER_IP=${server_ip}
+TLS=${tls}
+PATH_PREFIX=${path_prefix}
+PUSH_URLS=${push_urls}
+TUNNEL_URL=${tunnel_url}
+LISTEN_HOST=${listen_host}
 CONNECTION_URI=${connection_uri}
 CONTAINER_NAME=${CONTAINER_NAME}
 IMAGE_NAME=${IMAGE_NAME}
@@ -315,6 +369,7 @@ fi
 set -euo pipefail
 
 CONFIG_FILE="/etc/conduit-expose/config"
+DATA_DIR="/var/lib/conduit-expose"
 CONTAINER_NAME="conduit-expose"
 IMAGE_NAME="conduit-expose"
 REPO_URL="https://github.com/omid3098/conduit_expose"
@@ -391,6 +446,7 @@ cmd_update() {
     docker stop "$CONTAINER_NAME" 2>/dev/null || true
     docker rm "$CONTAINER_NAME" 2>/dev/null || true
 
+    mkdir -p "$DATA_DIR"
     docker run -d \
         --name "$CONTAINER_NAME" \
         --restart unless-stopped \
@@ -400,8 +456,13 @@ cmd_update() {
         -v /var/run/docker.sock:/var/run/docker.sock \
         -v /proc:/host/proc:ro \
         -v /:/host/root:ro \
+        -v "${DATA_DIR}:/var/lib/conduit-expose" \
         -e "CONDUIT_AUTH_SECRET=${AUTH_SECRET}" \
-        -e "CONDUIT_LISTEN_ADDR=:${PORT}" \
+        -e "CONDUIT_LISTEN_ADDR=${LISTEN_HOST:-}:${PORT}" \
+        -e "CONDUIT_TLS=${TLS:-false}" \
+        -e "CONDUIT_PATH_PREFIX=${PATH_PREFIX:-}" \
+        -e "CONDUIT_PUSH_URLS=${PUSH_URLS:-}" \
+        -e "CONDUIT_TUNNEL_URL=${TUNNEL_URL:-}" \
         "$IMAGE_NAME" >/dev/null
 
     log_success "Updated and running on port ${PORT}"
@@ -424,8 +485,8 @@ cmd_uninstall() {
     log_info "Removing image..."
     docker rmi "$IMAGE_NAME" 2>/dev/null || true
 
-    log_info "Removing config..."
-    rm -rf /etc/conduit-expose
+    log_info "Removing config and data..."
+    rm -rf /etc/conduit-expose "$DATA_DIR"
 
     log_info "Removing management CLI..."
     rm -f /usr/local/bin/conduit-expose-ctl
@@ -440,10 +501,14 @@ cmd_show_config() {
     echo -e "${BOLD}conduit-expose config${NC}"
     echo ""
     echo -e "  ${BOLD}Connection URI:${NC}"
-    echo -e "  ${GREEN}${CONNECTION_URI:-conduit://${AUTH_SECRET}@${SERVER_IP:-$(hostname -I 2>/dev/null | awk '{print $1}')}:${PORT}}${NC}"
+    echo -e "  ${GREEN}${CONNECTION_URI:-conduit://${AUTH_SECRET}@${SERVER_IP:-$(hostname -I 2>/dev/null | awk '{print $1}')}:${PORT}${PATH_PREFIX:-}}${NC}"
     echo ""
     echo -e "  Port:       ${PORT}"
     echo -e "  Secret:     ${AUTH_SECRET}"
+    echo -e "  TLS:        ${TLS:-false}"
+    echo -e "  Prefix:     ${PATH_PREFIX:-none}"
+    echo -e "  Push:       ${PUSH_URLS:-none}"
+    echo -e "  Tunnel:     ${TUNNEL_URL:-none}"
     echo -e "  Container:  ${CONTAINER_NAME}"
     echo -e "  Installed:  ${INSTALLED_AT:-unknown}"
     echo ""
@@ -451,7 +516,7 @@ cmd_show_config() {
 
 cmd_uri() {
     load_config
-    local uri="${CONNECTION_URI:-conduit://${AUTH_SECRET}@${SERVER_IP:-$(hostname -I 2>/dev/null | awk '{print $1}')}:${PORT}}"
+    local uri="${CONNECTION_URI:-conduit://${AUTH_SECRET}@${SERVER_IP:-$(hostname -I 2>/dev/null | awk '{print $1}')}:${PORT}${PATH_PREFIX:-}}"
     echo "$uri"
 }
 
@@ -486,7 +551,7 @@ case "${1:-}" in
             docker stop "$CONTAINER_NAME" 2>/dev/null || true
             docker rm "$CONTAINER_NAME" 2>/dev/null || true
             docker rmi "$IMAGE_NAME" 2>/dev/null || true
-            rm -rf "$CONFIG_DIR"
+            rm -rf "$CONFIG_DIR" "$DATA_DIR"
             rm -f "$CTL_PATH"
             log_success "conduit-expose uninstalled"
         fi
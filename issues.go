@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Status issues (containers[].errors, warnings)
+// ============================================================
+//
+// Failures during a poll are reported in the response as StatusIssues, so a
+// missing value comes with a reason: per container in containers[].errors
+// and for everything else in warnings. Each issue has a stable code (below)
+// and the time it was first seen.
+
+// Container error codes.
+const (
+	issueStatsFailed   = "stats_failed"   // Docker stats could not be read
+	issueInspectFailed = "inspect_failed" // docker inspect failed; no health or app metrics
+	issueLogsFailed    = "logs_failed"    // container logs could not be read; no app metrics
+	issueNoStatsLine   = "no_stats_line"  // no [STATS] line in the recent logs; no app metrics
+)
+
+// Warning codes.
+const (
+	issueHostProcUnavailable   = "host_proc_unavailable"   // no system metrics
+	issueCMDataUnavailable     = "cm_data_unavailable"     // no country, traffic or settings data
+	issueDiscoveryFailed       = "discovery_failed"        // containers could not be listed
+	issueSnowflakeScrapeFailed = "snowflake_scrape_failed" // one per failing snowflake proxy
+)
+
+type issueKey struct {
+	subject string // container name, snowflake instance, or "" for the host
+	code    string
+}
+
+// IssueTracker remembers when each issue was first seen, so one that
+// persists across polls keeps its first_seen. An issue absent from a
+// completed poll is forgotten.
+type IssueTracker struct {
+	mu      sync.Mutex
+	seen    map[issueKey]int64 // last completed poll
+	pending map[issueKey]int64 // poll in progress
+}
+
+func (t *IssueTracker) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = make(map[issueKey]int64)
+}
+
+func (t *IssueTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen = t.pending
+	t.pending = nil
+}
+
+// Issue returns the issue code about subject with its first-seen time and
+// records it for the poll in progress. Safe for concurrent use.
+func (t *IssueTracker) Issue(subject, code, msg string) StatusIssue {
+	now := time.Now().Unix()
+	k := issueKey{subject, code}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	first, ok := t.pending[k]
+	if !ok {
+		if first, ok = t.seen[k]; !ok {
+			first = now
+		}
+		if t.pending != nil {
+			t.pending[k] = first
+		}
+	}
+	return StatusIssue{Code: code, Message: msg, FirstSeen: first}
+}
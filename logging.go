@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Logging
+// ============================================================
+//
+// Everything logs through log/slog with a message and attributes. The same
+// keys are used everywhere so logs can be filtered:
+//
+//	container  container name
+//	stage      collection stage (see diagnostics.go)
+//	token      API token name
+//	ip         client IP
+//	error      the error
+//
+// Warnings and errors that repeat with identical attributes are logged once
+// per CONDUIT_LOG_DEDUP_WINDOW; the next occurrence after the window carries
+// the number of suppressed repeats.
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	// maxDedupEntries bounds the dedup table; expired entries are pruned
+	// when it is exceeded.
+	maxDedupEntries = 1024
+)
+
+// setupLogging installs the default slog logger according to cfg. Output of
+// the standard log package is routed through it as well.
+func setupLogging(cfg *Config, w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("CONDUIT_LOG_LEVEL: %w", err)
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		AddSource:   true,
+		ReplaceAttr: shortSource,
+	}
+	var h slog.Handler
+	switch strings.ToLower(cfg.LogFormat) {
+	case logFormatText:
+		h = slog.NewTextHandler(w, opts)
+	case logFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("CONDUIT_LOG_FORMAT must be %q or %q, got %q", logFormatText, logFormatJSON, cfg.LogFormat)
+	}
+	if cfg.LogDedupWindow > 0 {
+		h = newDedupHandler(h, cfg.LogDedupWindow)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// shortSource trims the source attribute to file:line, like log.Lshortfile.
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.SourceKey || len(groups) > 0 {
+		return a
+	}
+	if src, ok := a.Value.Any().(*slog.Source); ok {
+		if src.File == "" {
+			return slog.Attr{} // e.g. standard log output, which has no caller
+		}
+		a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+	}
+	return a
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// ============================================================
+// Deduplication of repeated warnings
+// ============================================================
+
+// dedupHandler drops warnings and errors that repeat within window. Records
+// below warning level are passed through.
+type dedupHandler struct {
+	next   slog.Handler
+	window time.Duration
+	state  *dedupState
+	scope  string // attributes and groups added with WithAttrs/WithGroup
+}
+
+type dedupState struct {
+	mu   sync.Mutex
+	seen map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	logged     time.Time
+	suppressed int
+}
+
+func newDedupHandler(next slog.Handler, window time.Duration) *dedupHandler {
+	return &dedupHandler{
+		next:   next,
+		window: window,
+		state:  &dedupState{seen: make(map[string]*dedupEntry)},
+	}
+}
+
+func (h *dedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+
+	var key strings.Builder
+	key.WriteString(h.scope)
+	key.WriteString(r.Level.String())
+	key.WriteByte(0)
+	key.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		key.WriteByte(0)
+		key.WriteString(a.String())
+		return true
+	})
+
+	suppressed, ok := h.state.admit(key.String(), r.Time, h.window)
+	if !ok {
+		return nil
+	}
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// admit reports whether a record with key seen at t should be logged, and
+// how many repeats were dropped since it last was.
+func (s *dedupState) admit(key string, t time.Time, window time.Duration) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.seen[key]; e != nil {
+		if t.Sub(e.logged) < window {
+			e.suppressed++
+			return 0, false
+		}
+		n := e.suppressed
+		e.logged, e.suppressed = t, 0
+		return n, true
+	}
+
+	if len(s.seen) >= maxDedupEntries {
+		for k, e := range s.seen {
+			if t.Sub(e.logged) >= window {
+				delete(s.seen, k)
+			}
+		}
+		if len(s.seen) >= maxDedupEntries {
+			return 0, true // too many distinct messages to track; log them all
+		}
+	}
+	s.seen[key] = &dedupEntry{logged: t}
+	return 0, true
+}
+
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scope := h.scope
+	for _, a := range attrs {
+		scope += a.String() + "\x00"
+	}
+	return &dedupHandler{next: h.next.WithAttrs(attrs), window: h.window, state: h.state, scope: scope}
+}
+
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{next: h.next.WithGroup(name), window: h.window, state: h.state, scope: h.scope + name + ".\x00"}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// ============================================================
+// Container logs (GET /containers/{id}/logs)
+// ============================================================
+//
+//	tail=100      lines from the end of the log (0-10000, default 100)
+//	since=10m     only lines newer than this: Unix seconds or a Go duration
+//	follow=1      keep streaming new lines, up to CONDUIT_LOGS_MAX_DURATION
+//	grep=regexp   only lines matching this (RE2) expression
+//	format=ndjson one ContainerLogLine per line instead of plain text
+//
+// Output is paced to CONDUIT_LOGS_MAX_RATE bytes per second. Client IP
+// addresses are replaced with <ip> unless CONDUIT_LOGS_SCRUB_IPS=false; grep
+// sees the scrubbed line, so it can't be used to probe for an address.
+
+const (
+	defaultLogsTail = 100
+	maxLogsTail     = 10000
+	maxLogsGrep     = 256
+
+	logsFormatText   = "text"
+	logsFormatNDJSON = "ndjson"
+
+	scrubbedIP = "<ip>"
+)
+
+type logsQuery struct {
+	tail   int
+	since  string // Unix seconds, as Docker expects
+	follow bool
+	grep   *regexp.Regexp
+	format string
+}
+
+func parseLogsQuery(q url.Values, now time.Time) (*logsQuery, error) {
+	lq := &logsQuery{tail: defaultLogsTail, format: logsFormatText}
+
+	if v := q.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxLogsTail {
+			return nil, fmt.Errorf("'tail' must be between 0 and %d", maxLogsTail)
+		}
+		lq.tail = n
+	}
+	if v := q.Get("since"); v != "" {
+		if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+			lq.since = strconv.FormatInt(ts, 10)
+		} else if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			lq.since = strconv.FormatInt(now.Add(-d).Unix(), 10)
+		} else {
+			return nil, fmt.Errorf("invalid 'since': %q (Unix seconds or a duration like 10m)", v)
+		}
+	}
+	if v := q.Get("follow"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'follow': %q", v)
+		}
+		lq.follow = b
+	}
+	if v := q.Get("grep"); v != "" {
+		if len(v) > maxLogsGrep {
+			return nil, fmt.Errorf("'grep' is longer than %d characters", maxLogsGrep)
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'grep': %v", err)
+		}
+		lq.grep = re
+	}
+	if v := q.Get("format"); v != "" {
+		if v != logsFormatText && v != logsFormatNDJSON {
+			return nil, fmt.Errorf("'format' must be %q or %q", logsFormatText, logsFormatNDJSON)
+		}
+		lq.format = v
+	}
+	return lq, nil
+}
+
+// containerLogsHandler serves GET /containers/{id}/logs.
+func containerLogsHandler(cli *client.Client, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lq, err := parseLogsQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctr, err := findContainer(r.Context(), cli, r.PathValue("id"))
+		if err != nil {
+			writeContainerLookupError(w, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.LogsMaxDuration)
+		defer cancel()
+		reader, err := cli.ContainerLogs(ctx, ctr.ID, container.LogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Timestamps: true,
+			Follow:     lq.follow,
+			Tail:       strconv.Itoa(lq.tail),
+			Since:      lq.since,
+		})
+		if err != nil {
+			slog.Warn("container logs unavailable", "container", containerName(ctr), "error", err)
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		defer reader.Close()
+
+		contentType := "text/plain; charset=utf-8"
+		if lq.format == logsFormatNDJSON {
+			contentType = "application/x-ndjson"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		rc := http.NewResponseController(w)
+		pace := newByteThrottle(cfg.LogsMaxRate, time.Now())
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false) // keep <ip> readable
+		err = readLogLines(reader, func(stream, raw string) error {
+			ts, line := splitLogTimestamp(raw)
+			if cfg.LogsScrubIPs {
+				line = scrubIPs(line)
+			}
+			if lq.grep != nil && !lq.grep.MatchString(line) {
+				return nil
+			}
+
+			buf.Reset()
+			if lq.format == logsFormatNDJSON {
+				enc.Encode(ContainerLogLine{Timestamp: ts, Stream: stream, Line: line})
+			} else {
+				buf.WriteString(line)
+				buf.WriteByte('\n')
+			}
+
+			if err := pace.wait(ctx, buf.Len()); err != nil {
+				return err
+			}
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			if lq.follow {
+				return rc.Flush()
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			slog.Debug("container log stream ended", "container", containerName(ctr), "error", err)
+		}
+	}
+}
+
+// splitLogTimestamp separates the RFC 3339 timestamp Docker prepends to
+// each line when asked for timestamps.
+func splitLogTimestamp(raw string) (ts, line string) {
+	ts, line, ok := strings.Cut(raw, " ")
+	if !ok {
+		return "", raw
+	}
+	if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		return "", raw
+	}
+	return ts, line
+}
+
+// ipCandidates matches things that look like IPv4 or IPv6 addresses;
+// scrubIPs confirms each with net.ParseIP, so times like 12:34:56 are kept.
+var ipCandidates = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b|(?:[0-9A-Fa-f]{0,4}:){2,7}(?:\d{1,3}(?:\.\d{1,3}){3}|[0-9A-Fa-f]{1,4})?`)
+
+// scrubIPs replaces every IP address in s with <ip>, except loopback and
+// unspecified addresses, which don't identify anyone.
+func scrubIPs(s string) string {
+	return ipCandidates.ReplaceAllStringFunc(s, func(m string) string {
+		ip := net.ParseIP(m)
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			return m
+		}
+		return scrubbedIP
+	})
+}
+
+// byteThrottle paces output to rate bytes per second, allowing a burst of
+// one second's worth. A rate of 0 or less disables it.
+type byteThrottle struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteThrottle(rate int, now time.Time) *byteThrottle {
+	return &byteThrottle{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// wait blocks until n more bytes may be written, or ctx is done.
+func (t *byteThrottle) wait(ctx context.Context, n int) error {
+	if t.rate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	t.tokens = min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate) - float64(n)
+	t.last = now
+	if t.tokens >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-t.tokens / t.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,47 +18,326 @@ import (
 )
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
 	cfg := loadConfig()
+	if err := setupLogging(cfg, os.Stderr); err != nil {
+		fatal("invalid logging config", "error", err)
+	}
 
 	if cfg.AuthSecret == "" {
-		log.Fatal("CONDUIT_AUTH_SECRET environment variable is required")
+		fatal("CONDUIT_AUTH_SECRET environment variable is required")
+	}
+
+	// "conduit-expose healthcheck" probes the running agent (Docker HEALTHCHECK)
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(cfg))
+	}
+
+	// /stream heartbeats run on a ticker, which needs a positive interval
+	if cfg.StreamHeartbeat <= 0 {
+		fatal("CONDUIT_STREAM_HEARTBEAT must be positive")
 	}
 
 	// Initialize Docker client
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		log.Fatalf("Failed to create Docker client: %v", err)
+		fatal("failed to create Docker client", "error", err)
 	}
 	defer cli.Close()
 
 	if _, err := cli.Ping(context.Background()); err != nil {
-		log.Fatalf("Cannot reach Docker daemon: %v", err)
+		fatal("cannot reach Docker daemon", "error", err)
 	}
-	log.Println("Connected to Docker daemon")
+	slog.Info("connected to Docker daemon")
 
 	// Initialize session tracker
 	session := NewSessionTracker()
 
+	// Initialize in-memory history of poll results
+	history := NewHistory(cfg.HistoryRetention, cfg.PollInterval)
+	onPoll := []func(*StatusResponse){history.Add}
+
+	// Open the on-disk store and reload history and session state from it.
+	// Without a usable data directory the agent still runs, just without
+	// persistence.
+	store, err := OpenStore(cfg.DataDir)
+	if err != nil {
+		slog.Warn("persistent store disabled", "path", cfg.DataDir, "error", err)
+	} else {
+		defer store.Close()
+
+		since := time.Now().Add(-cfg.HistoryRetention).Unix()
+		loaded := store.Range(since, time.Now().Unix())
+		for _, s := range loaded {
+			history.AddSample(s)
+		}
+		if state, ok := store.LoadSession(); ok {
+			session.Restore(state)
+		}
+		slog.Info("loaded history samples", "count", len(loaded), "path", cfg.DataDir)
+
+		onPoll = append(onPoll, store.Add, func(*StatusResponse) {
+			store.SaveSession(session.State())
+		})
+	}
+
 	// Initialize cache and start background polling
 	cache := &StatusCache{}
+	diag := NewDiagnostics()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go pollLoop(ctx, cli, cfg, cache, session)
+	// Push mode: send every poll result to the configured collectors too.
+	hostname, _ := os.Hostname()
+	push, err := NewPusher(cfg, hostname)
+	if err != nil {
+		fatal("invalid push configuration", "error", err)
+	}
+	if push != nil {
+		onPoll = append(onPoll, push.Add)
+		push.Run(ctx)
+	}
+
+	// InfluxDB and StatsD exporters, fed every poll result
+	exporters, err := NewExporters(cfg)
+	if err != nil {
+		fatal("invalid exporter configuration", "error", err)
+	}
+	if exporters != nil {
+		onPoll = append(onPoll, exporters.Add)
+		exporters.Run(ctx)
+	}
+
+	// Alert rules, evaluated on every poll
+	alerts, err := NewAlertEngine(cfg)
+	if err != nil {
+		fatal("failed to load alert rules", "error", err)
+	}
+	onPoll = append(onPoll, alerts.Evaluate)
+
+	// Notification channels for alerts that fire or resolve
+	notify, err := NewNotifications(cfg, hostname)
+	if err != nil {
+		fatal("invalid notification configuration", "error", err)
+	}
+	if notify != nil {
+		alerts.Notify = notify.Alert
+		notify.Run(ctx)
+	}
+
+	go pollLoop(ctx, cli, cfg, cache, session, diag, onPoll...)
+
+	// Authentication: master secret plus optional named tokens
+	auth, err := NewAuthenticator(cfg)
+	if err != nil {
+		fatal("failed to load API tokens", "error", err)
+	}
+	if cfg.TokensFile != "" && cfg.TokensReload > 0 {
+		go auth.watchTokensFile(ctx, cfg.TokensFile, cfg.TokensReload)
+	}
+
+	// Per-IP rate limiting and lockout after repeated auth failures
+	guard, err := NewGuard(cfg)
+	if err != nil {
+		fatal("invalid rate limit config", "error", err)
+	}
+	auth.OnFailure = guard.RecordAuthFailure
+	auth.OnSuccess = guard.RecordAuthSuccess
+	go guard.sweep(ctx)
+
+	// Set up HTTP routes, served under /v1 and unversioned (see apiversion.go)
+	ctl := NewController(cli, cfg)
+	containerID := apiParam{Name: "id", In: "path", Type: "string", Description: "Container name or ID prefix"}
+	routes := []apiRoute{
+		{
+			Path: "/status", Scope: scopeStatusRead, OperationID: "getStatus",
+			Summary: "Latest poll snapshot of the host and all containers",
+			Params: []apiParam{
+				{Name: "fields", In: "query", Type: "string", Description: "Comma-separated dotted paths to keep"},
+				{Name: "container", In: "query", Type: "string", Description: "Comma-separated container names or ID prefixes"},
+				{Name: "top_countries", In: "query", Type: "integer", Description: "Keep only the first N countries"},
+				{Name: "compact", In: "query", Type: "boolean", Description: "Short keys, zero values dropped"},
+			},
+			Response: StatusResponse{}, Handler: statusHandler(cache),
+		},
+		{
+			Path: "/metrics", Scope: scopeStatusRead, OperationID: "getMetrics",
+			Summary:  "Prometheus text exposition of the latest snapshot",
+			Response: "", ContentType: "text/plain; version=0.0.4", Handler: metricsHandler(cache, guard, diag, push),
+		},
+		{
+			Path: "/stream", Scope: scopeStatusRead, OperationID: "streamStatus",
+			Summary: "Server-Sent Events (or WebSocket) stream with one StatusResponse per poll",
+			Params: []apiParam{
+				{Name: "since", In: "query", Type: "integer", Description: "Replay snapshots newer than this Unix time"},
+			},
+			Response: StatusResponse{}, ContentType: "text/event-stream", Handler: streamHandler(cache, cfg),
+		},
+		{
+			Method: "GET", Path: "/containers/{id}", Scope: scopeContainersRead, OperationID: "getContainer",
+			Summary: "One container with inspect data, last [STATS] line and connections",
+			Params:  []apiParam{containerID}, Response: ContainerDetail{}, Handler: containerDetailHandler(cli, cfg, cache),
+		},
+		{
+			Method: "GET", Path: "/containers/{id}/logs", Scope: scopeContainersRead, OperationID: "getContainerLogs",
+			Summary: "Tail or follow a container's logs, as plain text or (format=ndjson) one JSON object per line",
+			Params: []apiParam{containerID,
+				{Name: "tail", In: "query", Type: "integer", Description: "Lines from the end of the log, 0-10000 (default 100)"},
+				{Name: "since", In: "query", Type: "string", Description: "Only lines newer than this: Unix seconds or a Go duration"},
+				{Name: "follow", In: "query", Type: "boolean", Description: "Keep streaming new lines"},
+				{Name: "grep", In: "query", Type: "string", Description: "Only lines matching this regular expression"},
+				{Name: "format", In: "query", Type: "string", Description: "text (default) or ndjson"},
+			},
+			Response: ContainerLogLine{}, ContentType: "application/x-ndjson", Handler: containerLogsHandler(cli, cfg),
+		},
+		{
+			Method: "POST", Path: "/containers/{id}/start", Scope: scopeContainersControl, OperationID: "startContainer",
+			Summary: "Start a container",
+			Params:  []apiParam{containerID}, Response: ContainerActionResponse{}, Handler: ctl.Handler(actionStart),
+		},
+		{
+			Method: "POST", Path: "/containers/{id}/stop", Scope: scopeContainersControl, OperationID: "stopContainer",
+			Summary: "Stop a container; without confirm, answers 202 with a confirmation code when confirmation is enabled",
+			Params: []apiParam{containerID,
+				{Name: "confirm", In: "query", Type: "string", Description: "Confirmation code from a previous 202 response"},
+			},
+			Response: ContainerActionResponse{}, AlsoStatus: []int{http.StatusAccepted}, Handler: ctl.Handler(actionStop),
+		},
+		{
+			Method: "POST", Path: "/containers/{id}/restart", Scope: scopeContainersControl, OperationID: "restartContainer",
+			Summary: "Restart a container",
+			Params:  []apiParam{containerID}, Response: ContainerActionResponse{}, Handler: ctl.Handler(actionRestart),
+		},
+		{
+			Path: "/history", Scope: scopeHistoryRead, OperationID: "getHistory",
+			Summary: "Downsampled time series of past polls",
+			Params: []apiParam{
+				{Name: "from", In: "query", Type: "integer", Description: "Start, Unix seconds (default: to - 1h)"},
+				{Name: "to", In: "query", Type: "integer", Description: "End, Unix seconds (default: now)"},
+				{Name: "step", In: "query", Type: "string", Description: "Bucket width, seconds or Go duration"},
+				{Name: "series", In: "query", Type: "string", Description: "Comma-separated series patterns"},
+			},
+			Response: HistoryResponse{}, Handler: historyHandler(history, store, cfg),
+		},
+		{
+			Path: "/alerts", Scope: scopeStatusRead, OperationID: "getAlerts",
+			Summary: "Pending, firing and recently resolved alerts, with the rules they come from",
+			Params: []apiParam{
+				{Name: "state", In: "query", Type: "string", Description: "Comma-separated states to keep: pending, firing, resolved"},
+			},
+			Response: AlertsResponse{}, Handler: alertsHandler(alerts),
+		},
+		{
+			Method: "POST", Path: "/notify/test", Scope: scopeNotifyTest, OperationID: "testNotifications",
+			Summary: "Send a sample notification; 502 when a channel fails",
+			Params: []apiParam{
+				{Name: "channel", In: "query", Type: "string", Description: "webhook, telegram or email (default: all configured)"},
+			},
+			Response: NotifyTestResponse{}, AlsoStatus: []int{http.StatusBadGateway}, Handler: notifyTestHandler(notify),
+		},
+	}
+
+	// /health and /ready can be moved to secret paths and/or put behind auth
+	ready := NewReadiness(cli, cfg, cache, &diag.Polls)
+	probes := []apiRoute{
+		{
+			Path: cfg.HealthPath, OperationID: "getHealth", Summary: "Liveness check",
+			Response: HealthResponse{}, Handler: healthHandler,
+		},
+		{
+			Path: cfg.ReadyPath, OperationID: "getReady", Summary: "Readiness check; 503 when a required check fails",
+			Response: ReadyResponse{}, AlsoStatus: []int{http.StatusServiceUnavailable}, Handler: ready.Handler(false),
+		},
+	}
+	for _, p := range probes {
+		if cfg.HealthAuth {
+			p.Scope = scopeStatusRead
+		}
+		routes = append(routes, p)
+	}
+	routes = append(routes, apiRoute{
+		Path: cfg.ReadyPath + "/details", Scope: scopeStatusRead, OperationID: "getReadyDetails",
+		Summary:  "Readiness check with the result of every check; 503 when a required check fails",
+		Response: ReadyResponse{}, AlsoStatus: []int{http.StatusServiceUnavailable}, Handler: ready.Handler(true),
+	})
+
+	routes = append(routes, apiRoute{
+		Method: "GET", Path: "/debug/collector", Scope: scopeStatusRead, OperationID: "getCollectorDiagnostics",
+		Summary:  "Poll loop, per-stage and per-container timings and the agent's own resource usage",
+		Response: CollectorDiagnostics{}, Handler: diagnosticsHandler(diag, guard),
+	})
+
+	routes = append(routes, apiRoute{
+		Method: "GET", Path: "/openapi.json", Scope: scopeStatusRead, OperationID: "getOpenAPI",
+		Summary: "This document", Handler: openAPIHandler(routes),
+	})
 
-	// Set up HTTP routes
 	mux := http.NewServeMux()
-	mux.HandleFunc("/status", authMiddleware(cfg.AuthSecret, statusHandler(cache)))
-	mux.HandleFunc("/health", healthHandler)
+	registerAPIRoutes(mux, auth, routes)
+
+	// Camouflage: decoy responses for everything a prober can reach
+	camo, err := NewCamouflage(cfg)
+	if err != nil {
+		fatal("invalid camouflage config", "error", err)
+	}
+
+	// Optional secret (and possibly rotating) prefix in front of every route
+	var handler http.Handler = mux
+	prefix, err := NewPathPrefix(cfg)
+	if err != nil {
+		fatal("invalid path prefix config", "error", err)
+	}
+	if prefix != nil {
+		if camo != nil {
+			prefix.NotFound = camo
+		}
+		handler = prefix.Middleware(mux)
+		if prefix.key != nil {
+			slog.Info("secret path prefix enabled", "rotate", prefix.window.String())
+		} else {
+			slog.Info("secret path prefix enabled")
+		}
+	}
+
+	if camo != nil {
+		auth.Unauthorized = camo
+		guard.Blocked = camo
+		mux.Handle("/", camo)
+		handler = camo.Wrap(handler)
+		if prefix == nil && (cfg.HealthPath == defaultHealthPath || cfg.ReadyPath == defaultReadyPath) && !cfg.HealthAuth {
+			slog.Warn("camouflage is on but /health or /ready is open; set CONDUIT_HEALTH_PATH, CONDUIT_READY_PATH or CONDUIT_HEALTH_AUTH")
+		}
+		slog.Info("camouflage enabled", "mode", camo.mode)
+	}
+
+	handler = guard.Middleware(handler)
+
+	// Outbound tunnel: serve the same handler over a connection to the dashboard
+	tunnel, err := NewTunnel(cfg, hostname, handler)
+	if err != nil {
+		fatal("invalid tunnel configuration", "error", err)
+	}
+	if tunnel != nil {
+		go tunnel.Run(ctx)
+	}
 
 	server := &http.Server{
 		Addr:         cfg.ListenAddr,
-		Handler:      mux,
+		Handler:      handler,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
+		ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	server.RegisterOnShutdown(cache.CloseSubscribers)
+
+	// TLS: provided certificate or a persisted self-signed one
+	if cfg.TLSEnabled {
+		tlsConfig, fingerprint, err := newServerTLSConfig(cfg)
+		if err != nil {
+			fatal("failed to set up TLS", "error", err)
+		}
+		server.TLSConfig = tlsConfig
+		slog.Info("TLS enabled", "sha256_fingerprint", fingerprint)
 	}
 
 	// Graceful shutdown
@@ -65,32 +345,51 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		log.Printf("conduit-expose listening on %s", cfg.ListenAddr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
+		slog.Info("conduit-expose listening", "addr", cfg.ListenAddr)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("HTTP server error", "error", err)
 		}
 	}()
 
 	sig := <-sigChan
-	log.Printf("Received %v, shutting down...", sig)
+	slog.Info("shutting down", "signal", sig.String())
 
 	cancel()
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
 
 	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
+		slog.Warn("HTTP server shutdown error", "error", err)
 	}
-	log.Println("conduit-expose stopped")
+	slog.Info("conduit-expose stopped")
 }
 
 // ============================================================
 // Polling Engine
 // ============================================================
 
-func pollLoop(ctx context.Context, cli *client.Client, cfg *Config, cache *StatusCache, session *SessionTracker) {
-	cache.Set(collectAll(ctx, cli, cfg, session))
-	log.Printf("Initial data collection complete (%d containers)", cache.Get().TotalContainers)
+// pollLoop runs collectAll every PollInterval, records its timings in diag,
+// stores the result in the cache and hands it to every onPoll hook (history,
+// exporters, ...) in order.
+func pollLoop(ctx context.Context, cli *client.Client, cfg *Config, cache *StatusCache, session *SessionTracker, diag *Diagnostics, onPoll ...func(*StatusResponse)) {
+	poll := func() {
+		diag.BeginPoll(time.Now())
+		resp, err := collectAll(ctx, cli, cfg, session, diag)
+		diag.EndPoll(time.Now(), err)
+		cache.Set(resp)
+		for _, hook := range onPoll {
+			hook(resp)
+		}
+	}
+
+	poll()
+	slog.Info("initial data collection complete", "containers", cache.Get().TotalContainers)
 
 	ticker := time.NewTicker(cfg.PollInterval)
 	defer ticker.Stop()
@@ -98,30 +397,47 @@ func pollLoop(ctx context.Context, cli *client.Client, cfg *Config, cache *Statu
 	for {
 		select {
 		case <-ticker.C:
-			cache.Set(collectAll(ctx, cli, cfg, session))
+			poll()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// collectAll performs a full collection cycle.
-func collectAll(ctx context.Context, cli *client.Client, cfg *Config, session *SessionTracker) *StatusResponse {
+// collectAll performs a full collection cycle, reporting the duration and
+// errors of every stage to diag. If containers can't be listed it returns a
+// response with host data only and the error.
+func collectAll(ctx context.Context, cli *client.Client, cfg *Config, session *SessionTracker, diag *Diagnostics) (*StatusResponse, error) {
 	hostname, _ := os.Hostname()
 
+	var warnings []StatusIssue
+
 	// 1. System-level metrics
+	start := time.Now()
 	systemMetrics := collectSystemMetrics(cfg)
+	var systemErr error
+	if systemMetrics == nil {
+		systemErr = fmt.Errorf("host proc not found at %s", cfg.HostProcPath)
+		warnings = append(warnings, diag.Issues.Issue("", issueHostProcUnavailable, systemErr.Error()))
+	}
+	diag.Observe(stageSystem, "", time.Since(start), systemErr)
 
 	// 2. Read Conduit Manager data files (country, traffic, settings, peak)
+	start = time.Now()
 	cmData := ReadCMData(cfg)
+	diag.Observe(stageCMData, "", time.Since(start), nil)
 	if !cmData.Available {
-		log.Println("WARN: Conduit Manager data not available at", cfg.CMDataPath())
+		slog.Warn("Conduit Manager data not available", "stage", stageCMData, "path", cfg.CMDataPath())
+		warnings = append(warnings, diag.Issues.Issue("", issueCMDataUnavailable,
+			"CM data not available at "+cfg.CMDataPath()))
 	}
 
 	// 3. Discover containers (with self-filtering)
+	start = time.Now()
 	containers, err := discoverContainers(ctx, cli)
+	diag.Observe(stageDiscovery, "", time.Since(start), err)
 	if err != nil {
-		log.Printf("WARN: container discovery failed: %v", err)
+		slog.Warn("container discovery failed", "stage", stageDiscovery, "error", err)
 		return &StatusResponse{
 			ServerID:        hostname,
 			Timestamp:       time.Now().Unix(),
@@ -129,7 +445,9 @@ func collectAll(ctx context.Context, cli *client.Client, cfg *Config, session *S
 			System:          systemMetrics,
 			Containers:      []ContainerInfo{},
 			CMAvailable:     cmData.Available,
-		}
+			Warnings: append(warnings, diag.Issues.Issue("", issueDiscoveryFailed,
+				"container discovery failed: "+err.Error())),
+		}, err
 	}
 
 	// 4. Parallel per-container collection
@@ -150,20 +468,35 @@ func collectAll(ctx context.Context, cli *client.Client, cfg *Config, session *S
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			info := collectContainerStats(ctx, cli, c, cfg)
+			start := time.Now()
+			info, statsErr := collectContainerStats(ctx, cli, c, cfg)
+			diag.Observe(stageStats, info.Name, time.Since(start), statsErr)
+			if statsErr != nil {
+				info.Errors = append(info.Errors, diag.Issues.Issue(info.Name, issueStatsFailed, statsErr.Error()))
+			}
 			var connStat *ConnectionStats
 			var autoStart bool
 
 			if info.Status == "running" {
+				start = time.Now()
 				inspect, inspectErr := cli.ContainerInspect(ctx, c.ID)
+				diag.Observe(stageInspect, info.Name, time.Since(start), inspectErr)
 				if inspectErr != nil {
-					log.Printf("WARN: cannot inspect %s: %v", info.Name, inspectErr)
+					slog.Warn("cannot inspect container", "container", info.Name, "stage", stageInspect, "error", inspectErr)
+					info.Errors = append(info.Errors, diag.Issues.Issue(info.Name, issueInspectFailed, inspectErr.Error()))
 				} else {
 					// App metrics from container logs ([STATS] lines)
+					start = time.Now()
 					appMetrics, metricsErr := fetchAppMetricsFromLogs(ctx, cli, c.ID, cfg)
-					if metricsErr != nil {
-						log.Printf("WARN: logs unavailable for %s: %v", info.Name, metricsErr)
-					} else if appMetrics != nil {
+					diag.Observe(stageLogs, info.Name, time.Since(start), metricsErr)
+					switch {
+					case metricsErr != nil:
+						slog.Warn("container logs unavailable", "container", info.Name, "stage", stageLogs, "error", metricsErr)
+						info.Errors = append(info.Errors, diag.Issues.Issue(info.Name, issueLogsFailed, metricsErr.Error()))
+					case appMetrics == nil:
+						info.Errors = append(info.Errors, diag.Issues.Issue(info.Name, issueNoStatsLine,
+							"no [STATS] line in the recent logs"))
+					default:
 						appMetrics.UptimeSeconds = containerUptimeSeconds(inspect)
 						info.AppMetrics = appMetrics
 					}
@@ -264,7 +597,17 @@ func collectAll(ctx context.Context, cli *client.Client, cfg *Config, session *S
 	// 9. Collect snowflake metrics if enabled
 	var snowflake *SnowflakeMetrics
 	if cmData.Available && cmData.Settings != nil && cmData.Settings.SnowflakeEnabled {
-		snowflake = collectSnowflakeMetrics(ctx, cfg)
+		start = time.Now()
+		var failures []*snowflakeScrapeError
+		snowflake, failures = collectSnowflakeMetrics(ctx, cfg)
+		var snowflakeErr error
+		if snowflake == nil {
+			snowflakeErr = errors.New("no snowflake proxy could be scraped")
+		}
+		diag.Observe(stageSnowflake, "", time.Since(start), snowflakeErr)
+		for _, f := range failures {
+			warnings = append(warnings, diag.Issues.Issue(f.Instance, issueSnowflakeScrapeFailed, f.Error()))
+		}
 	}
 
 	return &StatusResponse{
@@ -282,42 +625,72 @@ func collectAll(ctx context.Context, cli *client.Client, cfg *Config, session *S
 		Snowflake:         snowflake,
 		Containers:        containerInfos,
 		CMAvailable:       cmData.Available,
-	}
+		Warnings:          warnings,
+	}, nil
 }
 
 // ============================================================
 // HTTP Handlers
 // ============================================================
 
-func authMiddleware(secret string, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("X-Conduit-Auth")
-		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(`{"error":"unauthorized"}`))
-			return
-		}
-		next(w, r)
-	}
-}
-
+// statusHandler serves the latest snapshot, pre-serialized at poll time,
+// with ETag/Last-Modified validators and compression. Filtered requests
+// (see statusquery.go) are encoded per request.
 func statusHandler(cache *StatusCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		resp := cache.Get()
-		if resp == nil {
+		snap := cache.Snapshot(requestAPIVersion(r))
+		if snap == nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusServiceUnavailable)
 			w.Write([]byte(`{"error":"data not yet available"}`))
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
+
+		sq, err := parseStatusQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		etag := snap.etag
+		if !sq.IsZero() {
+			etag = variantETag(etag, r.URL.RawQuery)
+		}
+		setValidators(w, etag, snap.modified)
+		if notModified(r, etag, snap.modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if sq.IsZero() {
+			writeEncoded(w, r, snap.body, snap)
+			return
+		}
+
+		out, err := sq.Apply(snap.resp, snap.version)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		body, err := json.Marshal(out)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeEncoded(w, r, append(body, '\n'), nil)
 	}
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
+// writeJSONError writes {"error": msg} with the given status code.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok"}`))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, r, http.StatusOK, &HealthResponse{
+		APIVersion: requestAPIVersion(r),
+		Status:     "ok",
+	})
 }
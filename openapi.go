@@ -0,0 +1,300 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ============================================================
+// Route table and OpenAPI document
+// ============================================================
+//
+// Routes are declared once in apiRoute form. registerAPIRoutes mounts them
+// for every API version, and GET /v1/openapi.json describes them, with
+// schemas generated from the Go response types.
+
+// apiRoute describes one HTTP route.
+type apiRoute struct {
+	Method      string // "" = any method, documented as GET
+	Path        string // without the version prefix, e.g. /containers/{id}
+	Scope       string // required token scope; "" = no authentication
+	OperationID string
+	Summary     string
+	Params      []apiParam
+	Status      int    // success status; default 200
+	AlsoStatus  []int  // other statuses answered with the Response body
+	Response    any    // value of the success body type, nil for none
+	ContentType string // success content type; default application/json
+	Handler     http.HandlerFunc
+}
+
+// apiParam describes a path or query parameter.
+type apiParam struct {
+	Name        string
+	In          string // "path" or "query"
+	Type        string // JSON Schema type
+	Description string
+}
+
+// registerAPIRoutes mounts routes under every /<version> prefix and, for the
+// newest version, without a prefix.
+func registerAPIRoutes(mux *http.ServeMux, auth *Authenticator, routes []apiRoute) {
+	mount := func(prefix, version string) {
+		for _, rt := range routes {
+			h := withAPIVersion(version, rt.Handler)
+			if rt.Method != "" {
+				h = withMethod(rt.Method, h)
+			}
+			if rt.Scope != "" {
+				h = authMiddleware(auth, rt.Scope, h)
+			}
+			mux.HandleFunc(prefix+rt.Path, h)
+		}
+	}
+	for _, v := range apiVersions {
+		mount("/"+v, v)
+	}
+	mount("", latestAPIVersion())
+}
+
+// withMethod answers requests with any other method (HEAD is accepted for
+// GET) with 405. Routes are registered without a method pattern so that the
+// check runs after authentication: http.ServeMux's own 405 would tell an
+// unauthenticated prober, camouflage or not, which paths exist.
+func withMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method && !(method == http.MethodGet && r.Method == http.MethodHead) {
+			allow := method
+			if method == http.MethodGet {
+				allow += ", " + http.MethodHead
+			}
+			w.Header().Set("Allow", allow)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// openAPIHandler serves the OpenAPI document of the request's API version.
+// The server URL is taken from the request, so it includes any secret path
+// prefix.
+func openAPIHandler(routes []apiRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base, _, _ := strings.Cut(r.RequestURI, "?")
+		base = strings.TrimSuffix(base, "/openapi.json")
+		if base == "" {
+			base = "/"
+		}
+		writeAPIJSON(w, r, http.StatusOK, buildOpenAPI(routes, requestAPIVersion(r), base))
+	}
+}
+
+// ============================================================
+// Document types (OpenAPI 3.1)
+// ============================================================
+
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Security    []map[string][]string      `json:"security"`
+	Scope       string                     `json:"x-conduit-scope,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Required    bool           `json:"required,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema map[string]any `json:"schema"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]map[string]any `json:"schemas"`
+	SecuritySchemes map[string]map[string]any `json:"securitySchemes"`
+}
+
+// buildOpenAPI describes routes as served under base for the given version.
+func buildOpenAPI(routes []apiRoute, version, base string) *openAPIDoc {
+	g := &schemaGenerator{version: version, schemas: map[string]map[string]any{}}
+	errorResponse := openAPIResponse{
+		Description: "Error",
+		Content: map[string]openAPIMediaType{
+			"application/json": {Schema: g.schema(reflect.TypeOf(ErrorResponse{}))},
+		},
+	}
+
+	paths := map[string]map[string]*openAPIOperation{}
+	for _, rt := range routes {
+		op := &openAPIOperation{
+			OperationID: rt.OperationID,
+			Summary:     rt.Summary,
+			Responses:   map[string]openAPIResponse{"default": errorResponse},
+			Security:    []map[string][]string{},
+			Scope:       rt.Scope,
+		}
+		if rt.Scope != "" {
+			op.Security = []map[string][]string{{"signature": {}}, {"staticToken": {}}}
+		}
+		for _, p := range rt.Params {
+			op.Parameters = append(op.Parameters, openAPIParameter{
+				Name:        p.Name,
+				In:          p.In,
+				Required:    p.In == "path",
+				Description: p.Description,
+				Schema:      map[string]any{"type": p.Type},
+			})
+		}
+
+		status, contentType := rt.Status, rt.ContentType
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		success := openAPIResponse{Description: http.StatusText(status)}
+		if rt.Response != nil {
+			success.Content = map[string]openAPIMediaType{
+				contentType: {Schema: g.schema(reflect.TypeOf(rt.Response))},
+			}
+		}
+		op.Responses[strconv.Itoa(status)] = success
+		for _, s := range rt.AlsoStatus {
+			op.Responses[strconv.Itoa(s)] = openAPIResponse{Description: http.StatusText(s), Content: success.Content}
+		}
+
+		method := strings.ToLower(rt.Method)
+		if method == "" {
+			method = "get"
+		}
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = map[string]*openAPIOperation{}
+		}
+		paths[rt.Path][method] = op
+	}
+
+	return &openAPIDoc{
+		OpenAPI: "3.1.0",
+		Info:    openAPIInfo{Title: "conduit-expose", Version: version},
+		Servers: []openAPIServer{{URL: base}},
+		Paths:   paths,
+		Components: openAPIComponents{
+			Schemas: g.schemas,
+			SecuritySchemes: map[string]map[string]any{
+				"signature": {
+					"type": "apiKey", "in": "header", "name": headerSignature,
+					"description": "HMAC request signature, sent with " + headerKeyID + ", " + headerTimestamp + " and " + headerNonce,
+				},
+				"staticToken": {
+					"type": "apiKey", "in": "header", "name": headerLegacyAuth,
+				},
+			},
+		},
+	}
+}
+
+// ============================================================
+// JSON Schema generation
+// ============================================================
+
+// schemaGenerator turns Go types into JSON Schemas following encoding/json
+// rules. Named structs become components referenced by $ref.
+type schemaGenerator struct {
+	version string
+	schemas map[string]map[string]any
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = nil // reserve the name against recursion
+			g.schemas[name] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	g.addFields(t, props, &required)
+
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		slices.Sort(required)
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGenerator) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !fieldInVersion(f, g.version) {
+			continue
+		}
+		if et := embeddedStruct(f); et != nil {
+			g.addFields(et, props, required)
+			continue
+		}
+		name, omitempty := jsonField(f)
+		if name == "" {
+			continue
+		}
+		props[name] = g.schema(f.Type)
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================
+// Secret path prefix
+// ============================================================
+//
+// Every route can be moved under a secret prefix, e.g. /k3f9a2c1/status.
+// The prefix is a static string (CONDUIT_PATH_PREFIX), a segment that
+// rotates every CONDUIT_PATH_PREFIX_ROTATE, or both (static first):
+//
+//	segment = hex(HMAC-SHA256(key, WINDOW))[:16]
+//	key     = HMAC-SHA256(CONDUIT_AUTH_SECRET, "conduit-expose path prefix")
+//	WINDOW  = decimal floor(unix time / rotation seconds)
+//
+// The previous and next windows are accepted as well, to absorb clock skew
+// and requests in flight at a boundary. The prefix is stripped before
+// routing; r.RequestURI keeps it, so request signatures cover it.
+
+const (
+	pathPrefixKeyLabel   = "conduit-expose path prefix"
+	pathPrefixSegmentLen = 16
+	pathPrefixMinRotate  = time.Minute
+)
+
+// PathPrefix strips the secret prefix from requests and rejects requests
+// without it.
+type PathPrefix struct {
+	static string        // "" or "/segment[/segment...]"
+	key    []byte        // nil unless rotating
+	window time.Duration // rotation period
+
+	// NotFound answers requests without a valid prefix. Defaults to http.NotFound.
+	NotFound http.Handler
+}
+
+// NewPathPrefix returns the configured PathPrefix, or nil if neither a
+// static nor a rotating prefix is set. The rotation must be a whole number
+// of seconds, at least pathPrefixMinRotate, since dashboards compute the
+// window from Unix seconds.
+func NewPathPrefix(cfg *Config) (*PathPrefix, error) {
+	if cfg.PathPrefixRotate < 0 {
+		return nil, fmt.Errorf("CONDUIT_PATH_PREFIX_ROTATE must not be negative")
+	}
+	if cfg.PathPrefixRotate > 0 && (cfg.PathPrefixRotate < pathPrefixMinRotate || cfg.PathPrefixRotate%time.Second != 0) {
+		return nil, fmt.Errorf("CONDUIT_PATH_PREFIX_ROTATE must be whole seconds and at least %s, got %s", pathPrefixMinRotate, cfg.PathPrefixRotate)
+	}
+	static := strings.Trim(cfg.PathPrefix, "/")
+	if static == "" && cfg.PathPrefixRotate == 0 {
+		return nil, nil
+	}
+
+	p := &PathPrefix{NotFound: http.NotFoundHandler()}
+	if static != "" {
+		p.static = "/" + static
+	}
+	if cfg.PathPrefixRotate > 0 {
+		mac := hmac.New(sha256.New, []byte(cfg.AuthSecret))
+		mac.Write([]byte(pathPrefixKeyLabel))
+		p.key = mac.Sum(nil)
+		p.window = cfg.PathPrefixRotate
+	}
+	return p, nil
+}
+
+// rotatingSegment returns the path segment for window number n.
+func rotatingSegment(key []byte, n int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatInt(n, 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:pathPrefixSegmentLen]
+}
+
+// valid returns the prefixes accepted at now.
+func (p *PathPrefix) valid(now time.Time) []string {
+	if p.key == nil {
+		return []string{p.static}
+	}
+	n := now.Unix() / int64(p.window.Seconds())
+	return []string{
+		p.static + "/" + rotatingSegment(p.key, n),
+		p.static + "/" + rotatingSegment(p.key, n-1),
+		p.static + "/" + rotatingSegment(p.key, n+1),
+	}
+}
+
+// Middleware strips a valid prefix and passes the request on; anything
+// else goes to NotFound.
+func (p *PathPrefix) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range p.valid(time.Now()) {
+			rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+			if !ok || (rest != "" && rest[0] != '/') {
+				continue
+			}
+			if rest == "" {
+				rest = "/"
+			}
+
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = rest
+			if raw, ok := strings.CutPrefix(r.URL.RawPath, prefix); ok && raw != "" {
+				r2.URL.RawPath = raw
+			} else {
+				r2.URL.RawPath = ""
+			}
+			next.ServeHTTP(w, r2)
+			return
+		}
+		p.NotFound.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ============================================================
+// Prometheus Text Exposition (GET /metrics)
+// ============================================================
+
+// promWriter renders metric families in the Prometheus text exposition format
+// (version 0.0.4). Every family is written as a single block: HELP and TYPE
+// lines followed by all of its samples.
+type promWriter struct {
+	buf bytes.Buffer
+}
+
+// family writes the HELP and TYPE lines for a metric family.
+// typ is "gauge", "counter" or "histogram".
+func (p *promWriter) family(name, help, typ string) {
+	p.buf.WriteString("# HELP ")
+	p.buf.WriteString(name)
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(escapePromHelp(help))
+	p.buf.WriteString("\n# TYPE ")
+	p.buf.WriteString(name)
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(typ)
+	p.buf.WriteByte('\n')
+}
+
+// sample writes one sample line. labels is a flat list of name/value pairs.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.buf.WriteString(name)
+	if len(labels) >= 2 {
+		p.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			p.buf.WriteString(labels[i])
+			p.buf.WriteString(`="`)
+			p.buf.WriteString(escapePromLabel(labels[i+1]))
+			p.buf.WriteByte('"')
+		}
+		p.buf.WriteByte('}')
+	}
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	p.buf.WriteByte('\n')
+}
+
+// single writes a family that has exactly one unlabeled sample.
+func (p *promWriter) single(name, help, typ string, value float64) {
+	p.family(name, help, typ)
+	p.sample(name, value)
+}
+
+func escapePromHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func escapePromLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+const (
+	promGauge     = "gauge"
+	promCounter   = "counter"
+	promHistogram = "histogram"
+
+	bytesPerMB = 1024 * 1024
+	bytesPerGB = 1e9 // readDisk reports decimal gigabytes
+)
+
+// renderPrometheus converts a cached StatusResponse into Prometheus text format.
+// Values reported by the conduit containers as cumulative totals (traffic,
+// restarts, snowflake counters) are exposed as counters; everything else is a gauge.
+func renderPrometheus(resp *StatusResponse) []byte {
+	p := &promWriter{}
+
+	p.single("conduit_status_timestamp_seconds", "Unix time of the last completed collection cycle.", promGauge, float64(resp.Timestamp))
+	p.single("conduit_cm_available", "Whether Conduit Manager data files were readable (1) or not (0).", promGauge, boolToFloat(resp.CMAvailable))
+	p.single("conduit_containers", "Number of discovered conduit containers.", promGauge, float64(resp.TotalContainers))
+	p.single("conduit_connected_clients", "Connected clients summed across all containers.", promGauge, float64(resp.ConnectedClients))
+	p.single("conduit_connecting_clients", "Connecting clients summed across all containers.", promGauge, float64(resp.ConnectingClients))
+
+	writePromSystem(p, resp.System)
+	writePromSettings(p, resp.Settings)
+	writePromSession(p, resp.Session)
+	writePromConnections(p, resp.Connections)
+	writePromContainers(p, resp.Containers)
+	writePromSnowflake(p, resp.Snowflake)
+	writePromCountries(p, resp.ClientsByCountry, resp.TrafficByCountry)
+
+	return p.buf.Bytes()
+}
+
+func writePromSystem(p *promWriter, s *SystemMetrics) {
+	if s == nil {
+		return
+	}
+	p.single("conduit_system_cpu_percent", "Host CPU usage in percent.", promGauge, s.CPUPercent)
+	p.single("conduit_system_memory_used_bytes", "Host memory in use.", promGauge, s.MemoryUsedMB*bytesPerMB)
+	p.single("conduit_system_memory_total_bytes", "Host memory total.", promGauge, s.MemoryTotalMB*bytesPerMB)
+
+	p.family("conduit_system_load_average", "Host load average.", promGauge)
+	p.sample("conduit_system_load_average", s.LoadAvg1m, "period", "1m")
+	p.sample("conduit_system_load_average", s.LoadAvg5m, "period", "5m")
+	p.sample("conduit_system_load_average", s.LoadAvg15m, "period", "15m")
+
+	p.single("conduit_system_disk_used_bytes", "Host root filesystem space in use.", promGauge, s.DiskUsedGB*bytesPerGB)
+	p.single("conduit_system_disk_total_bytes", "Host root filesystem size.", promGauge, s.DiskTotalGB*bytesPerGB)
+	p.single("conduit_system_network_receive_mbps", "Host inbound network throughput over the last poll interval.", promGauge, s.NetInMbps)
+	p.single("conduit_system_network_transmit_mbps", "Host outbound network throughput over the last poll interval.", promGauge, s.NetOutMbps)
+	p.single("conduit_system_network_errors", "Host network errors during the last poll interval.", promGauge, float64(s.NetErrors))
+	p.single("conduit_system_network_drops", "Host network drops during the last poll interval.", promGauge, float64(s.NetDrops))
+}
+
+func writePromSettings(p *promWriter, s *ContainerSettings) {
+	if s == nil {
+		return
+	}
+	p.single("conduit_settings_max_clients", "Configured maximum clients per container.", promGauge, float64(s.MaxClients))
+	p.single("conduit_settings_bandwidth_limit_mbps", "Configured bandwidth limit per container.", promGauge, s.BandwidthLimitMbps)
+	p.single("conduit_settings_auto_start", "Whether any container restarts automatically.", promGauge, boolToFloat(s.AutoStart))
+}
+
+func writePromSession(p *promWriter, s *SessionInfo) {
+	if s == nil {
+		return
+	}
+	p.single("conduit_session_start_time_seconds", "Unix time the current session started.", promGauge, float64(s.StartTime))
+	p.single("conduit_session_peak_connections", "Peak connected clients in the current session.", promGauge, float64(s.PeakConnections))
+	p.single("conduit_session_avg_connections", "Average connected clients in the current session.", promGauge, s.AvgConnections)
+	p.single("conduit_session_upload_bytes_total", "Bytes uploaded in the current session.", promCounter, s.TotalUploadBytes)
+	p.single("conduit_session_download_bytes_total", "Bytes downloaded in the current session.", promCounter, s.TotalDownloadBytes)
+}
+
+func writePromConnections(p *promWriter, c *ConnectionStats) {
+	if c == nil {
+		return
+	}
+	p.single("conduit_tcp_connections", "Inbound TCP connections across all containers.", promGauge, float64(c.Total))
+	p.single("conduit_tcp_unique_ips", "Unique remote IPs across all containers.", promGauge, float64(c.UniqueIPs))
+
+	p.family("conduit_tcp_connections_by_state", "Inbound TCP connections by TCP state.", promGauge)
+	for _, state := range slices.Sorted(maps.Keys(c.States)) {
+		p.sample("conduit_tcp_connections_by_state", float64(c.States[state]), "state", state)
+	}
+}
+
+func writePromContainers(p *promWriter, containers []ContainerInfo) {
+	if len(containers) == 0 {
+		return
+	}
+
+	p.family("conduit_container_status", "Container status (1 for the current status label).", promGauge)
+	for _, c := range containers {
+		p.sample("conduit_container_status", 1, "container", c.Name, "id", c.ID, "status", c.Status)
+	}
+	p.family("conduit_container_cpu_percent", "Container CPU usage in percent.", promGauge)
+	for _, c := range containers {
+		p.sample("conduit_container_cpu_percent", c.CPUPercent, "container", c.Name)
+	}
+	p.family("conduit_container_memory_bytes", "Container memory usage.", promGauge)
+	for _, c := range containers {
+		p.sample("conduit_container_memory_bytes", c.MemoryMB*bytesPerMB, "container", c.Name)
+	}
+
+	// App metrics from [STATS] log lines
+	type appFamily struct {
+		name, help, typ string
+		value           func(*AppMetrics) float64
+	}
+	appFamilies := []appFamily{
+		{"conduit_container_connected_clients", "Connected clients reported by the container.", promGauge, func(m *AppMetrics) float64 { return float64(m.ConnectedClients) }},
+		{"conduit_container_connecting_clients", "Connecting clients reported by the container.", promGauge, func(m *AppMetrics) float64 { return float64(m.ConnectingClients) }},
+		{"conduit_container_announcing", "Announcements in flight reported by the container.", promGauge, func(m *AppMetrics) float64 { return float64(m.Announcing) }},
+		{"conduit_container_live", "Whether the container reported a [STATS] line.", promGauge, func(m *AppMetrics) float64 { return boolToFloat(m.IsLive) }},
+		{"conduit_container_uploaded_bytes_total", "Bytes uploaded since the container started.", promCounter, func(m *AppMetrics) float64 { return m.BytesUploaded }},
+		{"conduit_container_downloaded_bytes_total", "Bytes downloaded since the container started.", promCounter, func(m *AppMetrics) float64 { return m.BytesDownloaded }},
+		{"conduit_container_uptime_seconds", "Seconds since the container started.", promGauge, func(m *AppMetrics) float64 { return m.UptimeSeconds }},
+		{"conduit_container_idle_seconds", "Seconds the container has been idle.", promGauge, func(m *AppMetrics) float64 { return m.IdleSeconds }},
+	}
+	for _, f := range appFamilies {
+		p.family(f.name, f.help, f.typ)
+		for _, c := range containers {
+			if c.AppMetrics != nil {
+				p.sample(f.name, f.value(c.AppMetrics), "container", c.Name)
+			}
+		}
+	}
+
+	// Health from Docker inspect + /proc
+	type healthFamily struct {
+		name, help, typ string
+		value           func(*ContainerHealth) float64
+	}
+	healthFamilies := []healthFamily{
+		{"conduit_container_restarts_total", "Docker restart count for the container.", promCounter, func(h *ContainerHealth) float64 { return float64(h.RestartCount) }},
+		{"conduit_container_oom_killed", "Whether the container was last stopped by the OOM killer.", promGauge, func(h *ContainerHealth) float64 { return boolToFloat(h.OOMKilled) }},
+		{"conduit_container_open_fds", "Open file descriptors of the container's main process.", promGauge, func(h *ContainerHealth) float64 { return float64(h.FDCount) }},
+		{"conduit_container_threads", "Threads of the container's main process.", promGauge, func(h *ContainerHealth) float64 { return float64(h.ThreadCount) }},
+	}
+	for _, f := range healthFamilies {
+		p.family(f.name, f.help, f.typ)
+		for _, c := range containers {
+			if c.Health != nil {
+				p.sample(f.name, f.value(c.Health), "container", c.Name)
+			}
+		}
+	}
+}
+
+func writePromSnowflake(p *promWriter, s *SnowflakeMetrics) {
+	if s == nil {
+		return
+	}
+	p.single("conduit_snowflake_connections_total", "Connections handled by snowflake proxies.", promCounter, float64(s.TotalConnections))
+	p.single("conduit_snowflake_timeouts_total", "Connection timeouts in snowflake proxies.", promCounter, float64(s.TimeoutsTotal))
+	p.single("conduit_snowflake_inbound_bytes_total", "Inbound bytes through snowflake proxies.", promCounter, s.InboundBytes)
+	p.single("conduit_snowflake_outbound_bytes_total", "Outbound bytes through snowflake proxies.", promCounter, s.OutboundBytes)
+}
+
+func writePromCountries(p *promWriter, clients []CountryStats, traffic []CountryTrafficStats) {
+	if len(clients) > 0 {
+		p.family("conduit_country_clients", "Estimated connected clients by country.", promGauge)
+		for _, cs := range clients {
+			p.sample("conduit_country_clients", float64(cs.Connections), "country", cs.Country)
+		}
+	}
+	if len(traffic) > 0 {
+		p.family("conduit_country_from_bytes_total", "Bytes received from clients by country.", promCounter)
+		for _, ct := range traffic {
+			p.sample("conduit_country_from_bytes_total", ct.FromBytes, "country", ct.Country)
+		}
+		p.family("conduit_country_to_bytes_total", "Bytes sent to clients by country.", promCounter)
+		for _, ct := range traffic {
+			p.sample("conduit_country_to_bytes_total", ct.ToBytes, "country", ct.Country)
+		}
+	}
+}
+
+// writePromGuard exposes the agent's own request-blocking counters.
+func writePromGuard(p *promWriter, s GuardStats) {
+	p.family("conduit_expose_requests_blocked_total", "Requests rejected by the per-IP guard.", promCounter)
+	p.sample("conduit_expose_requests_blocked_total", float64(s.BlockedRateLimit), "reason", "rate_limit")
+	p.sample("conduit_expose_requests_blocked_total", float64(s.BlockedLockout), "reason", "lockout")
+	p.single("conduit_expose_auth_failures_total", "Requests with invalid credentials.", promCounter, float64(s.AuthFailures))
+	p.single("conduit_expose_lockouts_total", "Times a source IP was locked out after failed auth attempts.", promCounter, float64(s.Lockouts))
+	p.single("conduit_expose_locked_out_ips", "Source IPs currently locked out.", promGauge, float64(s.LockedOutIPs))
+	p.single("conduit_expose_tracked_ips", "Source IPs currently tracked by the rate limiter.", promGauge, float64(s.TrackedIPs))
+}
+
+func writePromPush(p *promWriter, stats []PushStats) {
+	if len(stats) == 0 {
+		return
+	}
+	p.family("conduit_expose_push_queue_length", "Snapshots waiting to be pushed to each collector.", promGauge)
+	for _, s := range stats {
+		p.sample("conduit_expose_push_queue_length", float64(s.Queued), "collector", s.Collector)
+	}
+	p.family("conduit_expose_push_sent_total", "Snapshots delivered to each collector.", promCounter)
+	for _, s := range stats {
+		p.sample("conduit_expose_push_sent_total", float64(s.Sent), "collector", s.Collector)
+	}
+	p.family("conduit_expose_push_failures_total", "Failed push attempts to each collector.", promCounter)
+	for _, s := range stats {
+		p.sample("conduit_expose_push_failures_total", float64(s.Failures), "collector", s.Collector)
+	}
+	p.family("conduit_expose_push_dropped_total", "Snapshots dropped because the queue overflowed or the collector rejected them.", promCounter)
+	for _, s := range stats {
+		p.sample("conduit_expose_push_dropped_total", float64(s.Dropped), "collector", s.Collector)
+	}
+}
+
+func writePromCollector(p *promWriter, d *CollectorDiagnostics) {
+	const poll = "conduit_expose_poll_duration_seconds"
+	p.family(poll, "Duration of complete collection cycles.", promHistogram)
+	for _, b := range d.Polls.Histogram {
+		p.sample(poll+"_bucket", float64(b.Count), "le", strconv.FormatFloat(b.LE, 'g', -1, 64))
+	}
+	p.sample(poll+"_bucket", float64(d.Polls.Count), "le", "+Inf")
+	p.sample(poll+"_sum", d.Polls.DurationSumSeconds)
+	p.sample(poll+"_count", float64(d.Polls.Count))
+	p.single("conduit_expose_poll_errors_total", "Collection cycles that failed to list containers.", promCounter, float64(d.Polls.Errors))
+
+	p.family("conduit_expose_stage_duration_seconds", "Duration of the last run of each collection stage.", promGauge)
+	for _, s := range d.Stages {
+		p.sample("conduit_expose_stage_duration_seconds", s.LastMs/1000, "stage", s.Stage)
+	}
+	p.family("conduit_expose_stage_errors_total", "Failed runs of each collection stage.", promCounter)
+	for _, s := range d.Stages {
+		p.sample("conduit_expose_stage_errors_total", float64(s.Errors), "stage", s.Stage)
+	}
+
+	p.single("conduit_expose_process_cpu_seconds_total", "CPU time used by the agent.", promCounter, d.Process.CPUSeconds)
+	p.single("conduit_expose_process_resident_memory_bytes", "Resident memory of the agent.", promGauge, d.Process.RSSMB*bytesPerMB)
+	p.single("conduit_expose_goroutines", "Goroutines in the agent.", promGauge, float64(d.Process.Goroutines))
+}
+
+// metricsHandler serves the cached StatusResponse in Prometheus text format,
+// followed by the agent's own counters. Like statusHandler, it only reads
+// from the cache and never touches Docker.
+func metricsHandler(cache *StatusCache, guard *Guard, diag *Diagnostics, push *Pusher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := cache.Get()
+		if resp == nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("data not yet available\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(renderPrometheus(resp))
+
+		p := &promWriter{}
+		writePromGuard(p, guard.Stats())
+		writePromCollector(p, diag.Snapshot())
+		writePromPush(p, push.Stats())
+		w.Write(p.buf.Bytes())
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================
+// Push mode (CONDUIT_PUSH_URLS)
+// ============================================================
+//
+// For nodes that can't accept inbound connections, the agent POSTs every
+// poll result to one or more collectors. Each collector has its own queue:
+// a snapshot stays queued until the collector answers 2xx, so an outage
+// delays data instead of losing it. The queue is bounded (oldest snapshots
+// are dropped first) and mirrored to <data dir>/push/ to survive restarts:
+// new snapshots are appended to the queue file, and a small head file
+// records how many of its lines were already delivered or dropped. The queue
+// file is only rewritten once that many lines pile up.
+// After an outage the backlog goes out in batches of CONDUIT_PUSH_BATCH.
+//
+// Requests are signed like inbound requests (see auth.go), with the
+// SHA-256 of the body appended to the signed string:
+//
+//	hex(HMAC-SHA256(key, METHOD + "\n" + PATH_AND_QUERY + "\n" + TIMESTAMP + "\n" + NONCE + "\n" + hex(SHA-256(body))))
+
+const (
+	pushBackoffBase = 5 * time.Second
+	userAgent       = "conduit-expose"
+
+	headerServerID      = "X-Conduit-Server-Id"
+	headerContentSHA256 = "X-Conduit-Content-Sha256"
+)
+
+// errPushRejected marks a batch the collector refused outright; retrying
+// it can't succeed.
+var errPushRejected = errors.New("rejected by collector")
+
+// Pusher sends poll results to the configured collectors.
+type Pusher struct {
+	targets []*pushTarget
+}
+
+// pushTarget is one collector URL with its queue.
+type pushTarget struct {
+	url        string
+	label      string // host, for logs and metrics; the URL may carry credentials
+	client     *http.Client
+	key        []byte
+	serverID   string
+	maxQueue   int
+	batch      int
+	backoffMax time.Duration
+	path       string // queue file, "" if there is no usable data dir
+	headPath   string // number of leading lines of path no longer queued
+
+	mu      sync.Mutex
+	queue   []pushEntry
+	nextSeq uint64
+	stale   int // lines at the start of the queue file that are no longer queued
+	wake    chan struct{}
+
+	sent     atomic.Int64
+	failures atomic.Int64
+	dropped  atomic.Int64
+}
+
+type pushEntry struct {
+	seq  uint64
+	data json.RawMessage
+}
+
+// PushStats is a snapshot of one collector's counters.
+type PushStats struct {
+	Collector string
+	Queued    int
+	Sent      int64 // snapshots delivered
+	Failures  int64 // failed attempts
+	Dropped   int64 // snapshots dropped on overflow or rejection
+}
+
+// NewPusher sets up a sender for every URL in CONDUIT_PUSH_URLS and loads
+// their queues from the data dir. It returns nil if push mode is off.
+func NewPusher(cfg *Config, serverID string) (*Pusher, error) {
+	if strings.TrimSpace(cfg.PushURLs) == "" {
+		return nil, nil
+	}
+	secret := cfg.PushSecret
+	if secret == "" {
+		secret = cfg.AuthSecret
+	}
+	if cfg.PushQueueSize < 1 || cfg.PushBatchSize < 1 {
+		return nil, fmt.Errorf("CONDUIT_PUSH_QUEUE and CONDUIT_PUSH_BATCH must be at least 1")
+	}
+	if cfg.PushBackoffMax < pushBackoffBase {
+		return nil, fmt.Errorf("CONDUIT_PUSH_BACKOFF_MAX must be at least %s", pushBackoffBase)
+	}
+
+	dir := filepath.Join(cfg.DataDir, "push")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		slog.Warn("push: queue is not persisted", "path", dir, "error", err)
+		dir = ""
+	}
+
+	p := &Pusher{}
+	for _, raw := range strings.Split(cfg.PushURLs, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid push URL %q", raw)
+		}
+		t := &pushTarget{
+			url:        raw,
+			label:      u.Host,
+			client:     &http.Client{Timeout: cfg.PushTimeout},
+			key:        deriveSigningKey(secret),
+			serverID:   serverID,
+			maxQueue:   cfg.PushQueueSize,
+			batch:      cfg.PushBatchSize,
+			backoffMax: cfg.PushBackoffMax,
+			wake:       make(chan struct{}, 1),
+		}
+		if dir != "" {
+			sum := sha256.Sum256([]byte(raw))
+			name := hex.EncodeToString(sum[:8])
+			t.path = filepath.Join(dir, name+".jsonl")
+			t.headPath = filepath.Join(dir, name+".head")
+			t.load()
+		}
+		p.targets = append(p.targets, t)
+	}
+	return p, nil
+}
+
+// Run sends queued snapshots until ctx is done.
+func (p *Pusher) Run(ctx context.Context) {
+	for _, t := range p.targets {
+		slog.Info("push mode enabled", "collector", t.label, "queued", len(t.queue))
+		go t.run(ctx)
+	}
+}
+
+// Add queues a poll result for every collector. It is meant to be passed to
+// pollLoop as a hook.
+func (p *Pusher) Add(resp *StatusResponse) {
+	v := *resp
+	v.APIVersion = latestAPIVersion()
+	data, err := marshalVersioned(&v, v.APIVersion)
+	if err != nil {
+		slog.Error("push: cannot serialize status", "error", err)
+		return
+	}
+	for _, t := range p.targets {
+		t.add(data)
+	}
+}
+
+// Stats returns the counters of every collector.
+func (p *Pusher) Stats() []PushStats {
+	if p == nil {
+		return nil
+	}
+	out := make([]PushStats, 0, len(p.targets))
+	for _, t := range p.targets {
+		t.mu.Lock()
+		queued := len(t.queue)
+		t.mu.Unlock()
+		out = append(out, PushStats{
+			Collector: t.label,
+			Queued:    queued,
+			Sent:      t.sent.Load(),
+			Failures:  t.failures.Load(),
+			Dropped:   t.dropped.Load(),
+		})
+	}
+	return out
+}
+
+// ============================================================
+// Queue
+// ============================================================
+
+// load reads the queue file, skipping the lines the head file counts, and
+// rewrites it so it holds exactly the queue.
+func (t *pushTarget) load() {
+	lines := safeReadLines(t.path)
+	if data, err := os.ReadFile(t.headPath); err == nil {
+		head, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		lines = lines[min(max(head, 0), len(lines)):]
+	}
+	if len(lines) > t.maxQueue {
+		lines = lines[len(lines)-t.maxQueue:]
+	}
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			continue
+		}
+		t.nextSeq++
+		t.queue = append(t.queue, pushEntry{seq: t.nextSeq, data: json.RawMessage(line)})
+	}
+	t.persistLocked()
+}
+
+func (t *pushTarget) add(data json.RawMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextSeq++
+	t.queue = append(t.queue, pushEntry{seq: t.nextSeq, data: data})
+	if over := len(t.queue) - t.maxQueue; over > 0 {
+		t.queue = t.queue[over:]
+		t.stale += over
+		t.dropped.Add(int64(over))
+	}
+
+	// Overflow drops needn't be recorded in the head file: load keeps only
+	// the newest CONDUIT_PUSH_QUEUE lines anyway.
+	if t.path != "" {
+		if err := appendLine(t.path, data); err != nil {
+			slog.Warn("push: cannot write queue", "collector", t.label, "path", t.path, "error", err)
+		}
+		t.compactLocked()
+	}
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// peek returns up to n of the oldest queued entries.
+func (t *pushTarget) peek(n int) []pushEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]pushEntry(nil), t.queue[:min(n, len(t.queue))]...)
+}
+
+// remove drops entries up to and including seq. Entries may already be gone
+// if they overflowed while being sent.
+func (t *pushTarget) remove(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := 0
+	for i < len(t.queue) && t.queue[i].seq <= seq {
+		i++
+	}
+	t.queue = t.queue[i:]
+	if t.path == "" || i == 0 {
+		return
+	}
+	t.stale += i
+	if !t.compactLocked() {
+		t.writeHeadLocked(t.stale)
+	}
+}
+
+// compactLocked rewrites the queue file once more than half the queue size
+// in lines are stale, so catching up after an outage rewrites it only a few
+// times. It reports whether it did.
+func (t *pushTarget) compactLocked() bool {
+	if t.stale <= t.maxQueue/2 {
+		return false
+	}
+	t.persistLocked()
+	return true
+}
+
+// persistLocked rewrites the queue file from memory. The head file is
+// reset first: a crash in between then sends some snapshots twice, rather
+// than skipping undelivered ones.
+func (t *pushTarget) persistLocked() {
+	if !t.writeHeadLocked(0) {
+		return
+	}
+	var buf bytes.Buffer
+	for _, e := range t.queue {
+		buf.Write(e.data)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(t.path, buf.Bytes(), 0o600); err != nil {
+		slog.Warn("push: cannot write queue", "collector", t.label, "path", t.path, "error", err)
+		return
+	}
+	t.stale = 0
+}
+
+// writeHeadLocked records that the first n lines of the queue file are no
+// longer queued.
+func (t *pushTarget) writeHeadLocked(n int) bool {
+	if err := writeFileAtomic(t.headPath, []byte(strconv.Itoa(n)+"\n"), 0o600); err != nil {
+		slog.Warn("push: cannot write queue", "collector", t.label, "path", t.headPath, "error", err)
+		return false
+	}
+	return true
+}
+
+func appendLine(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ============================================================
+// Sending
+// ============================================================
+
+func (t *pushTarget) run(ctx context.Context) {
+	failures := 0
+	for {
+		batch := t.peek(t.batch)
+		if len(batch) == 0 {
+			select {
+			case <-t.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := t.send(ctx, batch)
+		if ctx.Err() != nil {
+			return
+		}
+		last := batch[len(batch)-1].seq
+		switch {
+		case err == nil:
+			t.remove(last)
+			t.sent.Add(int64(len(batch)))
+			if failures > 0 {
+				slog.Info("push: collector reachable again", "collector", t.label, "snapshots", len(batch))
+			}
+			failures = 0
+			continue
+		case errors.Is(err, errPushRejected):
+			t.remove(last)
+			t.dropped.Add(int64(len(batch)))
+			slog.Warn("push: dropping batch", "collector", t.label, "snapshots", len(batch), "error", err)
+			continue
+		}
+
+		failures++
+		t.failures.Add(1)
+		wait := backoffDelay(pushBackoffBase, t.backoffMax, failures)
+		slog.Warn("push failed", "collector", t.label, "retry_in", wait.Round(time.Second).String(), "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// send POSTs batch as one PushBatch.
+func (t *pushTarget) send(ctx context.Context, batch []pushEntry) error {
+	body := PushBatch{
+		APIVersion: latestAPIVersion(),
+		ServerID:   t.serverID,
+		SentAt:     time.Now().Unix(),
+		Snapshots:  make([]json.RawMessage, len(batch)),
+	}
+	for i, e := range batch {
+		body.Snapshots[i] = e.data
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(headerServerID, t.serverID)
+	signBody(req, t.key, data)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest,
+		resp.StatusCode == http.StatusRequestEntityTooLarge,
+		resp.StatusCode == http.StatusUnprocessableEntity:
+		return fmt.Errorf("%w: HTTP %d", errPushRejected, resp.StatusCode)
+	}
+	return fmt.Errorf("HTTP %d", resp.StatusCode)
+}
+
+// signBody signs an outgoing request with the given body as described
+// above.
+func signBody(req *http.Request, key, body []byte) {
+	nonceBytes := make([]byte, 16)
+	rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sum := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(sum[:])
+
+	req.Header.Set(headerTimestamp, ts)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerContentSHA256, bodyHash)
+	req.Header.Set(headerSignature, signRequest(key, req.Method, req.URL.RequestURI(), ts, nonce+"\n"+bodyHash))
+}
+
+// backoffDelay returns the wait after the given number of consecutive
+// failures: base doubling up to max, with the upper half randomized so
+// agents don't retry in lockstep. A max below base never shortens the wait
+// to zero.
+func backoffDelay(base, max time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	d = min(d, max)
+	if d <= 0 {
+		return base
+	}
+	return d/2 + time.Duration(mrand.Int64N(int64(d/2)+1))
+}
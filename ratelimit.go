@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================
+// Per-IP rate limiting and failed-auth lockout
+// ============================================================
+//
+// Guard wraps the whole mux. Every request first resolves its client IP
+// (honoring X-Forwarded-For only from CONDUIT_TRUSTED_PROXIES), is rejected
+// if that IP is locked out, and then takes a token from the IP's bucket.
+// Failed authentication attempts, reported by the Authenticator, lock an IP
+// out for LockoutBase after LockoutThreshold failures, doubling with every
+// further failure up to LockoutMax.
+//
+// Tunnelled requests all arrive from the dashboard's address, so they are
+// keyed on the client IP the dashboard puts in the frame instead. Those
+// without one share a bucket of their own and are never locked out.
+
+const (
+	guardSweepInterval = time.Minute
+	guardIdleTTL       = 10 * time.Minute // forget IPs idle this long
+	guardTunnelKey     = "tunnel"         // tunnelled requests without a peer
+)
+
+// Guard enforces per-IP request rates and auth-failure lockouts.
+type Guard struct {
+	rate      float64 // tokens per second; 0 disables rate limiting
+	burst     float64
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	proxies   []*net.IPNet
+
+	// Blocked, if set, answers rejected requests in place of the JSON 429
+	// (see camouflage.go).
+	Blocked http.Handler
+
+	mu      sync.Mutex
+	clients map[string]*guardClient
+
+	blockedRate    atomic.Int64
+	blockedLockout atomic.Int64
+	authFailures   atomic.Int64
+	lockouts       atomic.Int64
+}
+
+// guardClient is the state kept per source IP.
+type guardClient struct {
+	tokens      float64
+	lastRefill  time.Time // also the time of the last request
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// GuardStats is a snapshot of the Guard's counters.
+type GuardStats struct {
+	BlockedRateLimit int64 `json:"blocked_rate_limit"`
+	BlockedLockout   int64 `json:"blocked_lockout"`
+	AuthFailures     int64 `json:"auth_failures"`
+	Lockouts         int64 `json:"lockouts"`
+	TrackedIPs       int   `json:"tracked_ips"`
+	LockedOutIPs     int   `json:"locked_out_ips"`
+}
+
+// NewGuard creates a Guard from the runtime config. Invalid trusted proxy
+// entries are an error.
+func NewGuard(cfg *Config) (*Guard, error) {
+	g := &Guard{
+		rate:      cfg.RateLimit,
+		burst:     float64(cfg.RateBurst),
+		threshold: cfg.LockoutThreshold,
+		base:      cfg.LockoutBase,
+		max:       cfg.LockoutMax,
+		clients:   make(map[string]*guardClient),
+	}
+	if g.burst < 1 {
+		g.burst = 1
+	}
+
+	for _, p := range strings.Split(cfg.TrustedProxies, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("CONDUIT_TRUSTED_PROXIES: %w", err)
+		}
+		g.proxies = append(g.proxies, n)
+	}
+	return g, nil
+}
+
+// Middleware resolves the client IP and applies lockout and rate limiting
+// before handing the request to next.
+func (g *Guard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := g.resolveIP(r)
+		key := ip.String()
+		if peer, ok := r.Context().Value(tunnelPeerContextKey{}).(string); ok {
+			ip = net.ParseIP(peer)
+			key = ip.String()
+			if ip == nil {
+				key = guardTunnelKey
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
+
+		if wait, blocked := g.check(key, time.Now()); blocked {
+			if g.Blocked != nil {
+				g.Blocked.ServeHTTP(w, r)
+			} else {
+				writeTooManyRequests(w, wait)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check returns how long the client must wait if the request is blocked.
+func (g *Guard) check(key string, now time.Time) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c := g.clients[key]
+	if c == nil {
+		c = &guardClient{tokens: g.burst, lastRefill: now}
+		g.clients[key] = c
+	}
+
+	elapsed := now.Sub(c.lastRefill)
+	c.lastRefill = now
+
+	if now.Before(c.lockedUntil) {
+		g.blockedLockout.Add(1)
+		return c.lockedUntil.Sub(now), true
+	}
+
+	if g.rate <= 0 {
+		return 0, false
+	}
+	c.tokens = math.Min(g.burst, c.tokens+elapsed.Seconds()*g.rate)
+	if c.tokens < 1 {
+		g.blockedRate.Add(1)
+		return time.Duration((1 - c.tokens) / g.rate * float64(time.Second)), true
+	}
+	c.tokens--
+	return 0, false
+}
+
+// RecordAuthFailure counts a failed authentication from ip and locks it out
+// once the threshold is reached. Failures are forgotten after LockoutMax
+// without another one.
+func (g *Guard) RecordAuthFailure(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	g.authFailures.Add(1)
+	if g.threshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	key := ip.String()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c := g.clients[key]
+	if c == nil {
+		c = &guardClient{tokens: g.burst, lastRefill: now}
+		g.clients[key] = c
+	}
+	if now.Sub(c.lastFailure) > g.max {
+		c.failures = 0
+	}
+	c.failures++
+	c.lastFailure = now
+
+	if c.failures < g.threshold {
+		return
+	}
+	// base, 2*base, 4*base, ... capped at max
+	d := g.base << min(c.failures-g.threshold, 30)
+	if d <= 0 || d > g.max {
+		d = g.max
+	}
+	c.lockedUntil = now.Add(d)
+	g.lockouts.Add(1)
+	slog.Warn("guard: locked out after failed auth attempts", "ip", key, "duration", d.String(), "failures", c.failures)
+}
+
+// RecordAuthSuccess clears the failure count of ip.
+func (g *Guard) RecordAuthSuccess(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c := g.clients[ip.String()]; c != nil {
+		c.failures = 0
+	}
+}
+
+// Stats returns the current counters.
+func (g *Guard) Stats() GuardStats {
+	s := GuardStats{
+		BlockedRateLimit: g.blockedRate.Load(),
+		BlockedLockout:   g.blockedLockout.Load(),
+		AuthFailures:     g.authFailures.Load(),
+		Lockouts:         g.lockouts.Load(),
+	}
+	now := time.Now()
+	g.mu.Lock()
+	s.TrackedIPs = len(g.clients)
+	for _, c := range g.clients {
+		if now.Before(c.lockedUntil) {
+			s.LockedOutIPs++
+		}
+	}
+	g.mu.Unlock()
+	return s
+}
+
+// sweep periodically drops clients that have been idle for a while and
+// are not locked out, so the map doesn't grow with every IP ever seen.
+func (g *Guard) sweep(ctx context.Context) {
+	ticker := time.NewTicker(guardSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			g.mu.Lock()
+			for key, c := range g.clients {
+				idle := now.Sub(c.lastRefill) > guardIdleTTL && now.Sub(c.lastFailure) > g.max
+				if idle && now.After(c.lockedUntil) {
+					delete(g.clients, key)
+				}
+			}
+			g.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resolveIP returns the request's client address. X-Forwarded-For is only
+// believed when the direct peer is a trusted proxy; it is then walked from
+// the right, skipping further trusted proxies.
+func (g *Guard) resolveIP(r *http.Request) net.IP {
+	peer := remoteIP(r)
+	if peer == nil || !g.trusted(peer) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !g.trusted(ip) {
+			return ip
+		}
+		peer = ip
+	}
+	return peer
+}
+
+func (g *Guard) trusted(ip net.IP) bool {
+	for _, n := range g.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientIPContextKey struct{}
+
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSONError(w, http.StatusTooManyRequests, "too many requests")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// ============================================================
+// Readiness
+// ============================================================
+//
+// /health only says the process is up. /ready also checks that the
+// collector can do its job and answers 503 when a required check fails:
+//
+//	docker     the daemon answers a ping                    required
+//	poll       the last successful poll is recent enough    required
+//	host_proc  the host's /proc is mounted                  required
+//	host_root  the host's root filesystem is mounted        optional
+//	cm_data    the last poll found Conduit Manager's data   optional
+//	snowflake  the last poll scraped snowflake, if enabled  optional
+//
+// Results are cached briefly so unauthenticated probes can't hammer the
+// Docker socket.
+
+const (
+	readyCacheTTL = 2 * time.Second
+
+	readyStatusReady    = "ready"
+	readyStatusNotReady = "not_ready"
+
+	checkOK      = "ok"
+	checkFail    = "fail"
+	checkWarn    = "warn"
+	checkSkipped = "skipped"
+)
+
+// Readiness evaluates the readiness checks.
+type Readiness struct {
+	cli   *client.Client
+	cfg   *Config
+	cache *StatusCache
+	polls *PollState
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	checks    []ReadyCheck
+}
+
+func NewReadiness(cli *client.Client, cfg *Config, cache *StatusCache, polls *PollState) *Readiness {
+	return &Readiness{cli: cli, cfg: cfg, cache: cache, polls: polls}
+}
+
+// Handler serves /ready, or with details the check list as well.
+func (rd *Readiness) Handler(details bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := rd.Checks(r.Context())
+
+		resp := &ReadyResponse{
+			APIVersion: requestAPIVersion(r),
+			Status:     readyStatusReady,
+		}
+		for _, c := range checks {
+			if c.Required && c.Status == checkFail {
+				resp.Status = readyStatusNotReady
+			}
+		}
+		if details {
+			resp.Checks = checks
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		status := http.StatusOK
+		if resp.Status != readyStatusReady {
+			status = http.StatusServiceUnavailable
+		}
+		writeAPIJSON(w, r, status, resp)
+	}
+}
+
+// Checks runs the readiness checks, or returns the cached result if it is
+// recent enough.
+func (rd *Readiness) Checks(ctx context.Context) []ReadyCheck {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	now := time.Now()
+	if rd.checks != nil && now.Sub(rd.checkedAt) < readyCacheTTL {
+		return rd.checks
+	}
+
+	latest := rd.cache.Get()
+	rd.checks = []ReadyCheck{
+		rd.checkDocker(ctx),
+		rd.checkPoll(now),
+		checkPath("host_proc", filepath.Join(rd.cfg.HostProcPath, "stat"), true),
+		checkPath("host_root", rd.cfg.HostRootPath, false),
+		checkCMData(latest),
+		checkSnowflake(latest),
+	}
+	rd.checkedAt = now
+	return rd.checks
+}
+
+func (rd *Readiness) checkDocker(ctx context.Context) ReadyCheck {
+	c := ReadyCheck{Name: "docker", Status: checkOK, Required: true}
+
+	// Not tied to the request, whose cancellation would poison the cache
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rd.cfg.DockerTimeout)
+	defer cancel()
+	if _, err := rd.cli.Ping(ctx); err != nil {
+		c.Status = checkFail
+		c.Message = err.Error()
+	}
+	return c
+}
+
+func (rd *Readiness) checkPoll(now time.Time) ReadyCheck {
+	c := ReadyCheck{Name: "poll", Status: checkOK, Required: true}
+	lastAttempt, lastSuccess, lastErr := rd.polls.Get()
+
+	switch {
+	case lastSuccess.IsZero() && lastAttempt.IsZero():
+		c.Status = checkFail
+		c.Message = "first poll still running"
+	case lastSuccess.IsZero():
+		c.Status = checkFail
+		c.Message = fmt.Sprintf("no successful poll yet: %v", lastErr)
+	case now.Sub(lastSuccess) > rd.cfg.ReadyMaxPollAge:
+		c.Status = checkFail
+		c.Message = fmt.Sprintf("last successful poll %s ago, limit %s (interval %s)",
+			now.Sub(lastSuccess).Round(time.Second), rd.cfg.ReadyMaxPollAge, rd.cfg.PollInterval)
+		if lastErr != nil {
+			c.Message += fmt.Sprintf(": %v", lastErr)
+		}
+	case lastErr != nil:
+		c.Status = checkWarn
+		c.Message = fmt.Sprintf("last poll failed: %v", lastErr)
+	default:
+		c.Message = fmt.Sprintf("last successful poll %s ago", now.Sub(lastSuccess).Round(time.Second))
+	}
+	return c
+}
+
+func checkPath(name, path string, required bool) ReadyCheck {
+	c := ReadyCheck{Name: name, Status: checkOK, Required: required}
+	if _, err := os.Stat(path); err != nil {
+		c.Status = checkWarn
+		if required {
+			c.Status = checkFail
+		}
+		c.Message = err.Error()
+	}
+	return c
+}
+
+func checkCMData(latest *StatusResponse) ReadyCheck {
+	c := ReadyCheck{Name: "cm_data", Status: checkOK}
+	switch {
+	case latest == nil:
+		c.Status = checkSkipped
+		c.Message = "no poll yet"
+	case !latest.CMAvailable:
+		c.Status = checkWarn
+		c.Message = "Conduit Manager data not found; country and settings data unavailable"
+	}
+	return c
+}
+
+func checkSnowflake(latest *StatusResponse) ReadyCheck {
+	c := ReadyCheck{Name: "snowflake", Status: checkOK}
+	switch {
+	case latest == nil:
+		c.Status = checkSkipped
+		c.Message = "no poll yet"
+	case latest.Settings == nil || !latest.Settings.SnowflakeEnabled:
+		c.Status = checkSkipped
+		c.Message = "snowflake not enabled"
+	case latest.Snowflake == nil:
+		c.Status = checkWarn
+		c.Message = "no snowflake proxy could be scraped"
+	}
+	return c
+}
+
+// ============================================================
+// Container healthcheck (conduit-expose healthcheck)
+// ============================================================
+
+// runHealthcheck asks the running agent's /ready endpoint over loopback and
+// returns the process exit code, for Docker's HEALTHCHECK. It uses the same
+// environment as the agent, so it follows the listen address, TLS, path
+// prefix and CONDUIT_HEALTH_AUTH.
+func runHealthcheck(cfg *Config) int {
+	host, port, err := net.SplitHostPort(cfg.ListenAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid CONDUIT_LISTEN_ADDR %q: %v\n", cfg.ListenAddr, err)
+		return 1
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	scheme := "http"
+	if cfg.TLSEnabled {
+		scheme = "https"
+	}
+	uri := cfg.ReadyPath
+	prefix, err := NewPathPrefix(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if prefix != nil {
+		uri = prefix.valid(time.Now())[0] + uri
+	}
+
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+net.JoinHostPort(host, port)+uri, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cfg.HealthAuth {
+		buf := make([]byte, 16)
+		rand.Read(buf)
+		nonce := hex.EncodeToString(buf)
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(headerTimestamp, ts)
+		req.Header.Set(headerNonce, nonce)
+		req.Header.Set(headerSignature, signRequest(deriveSigningKey(cfg.AuthSecret), req.Method, uri, ts, nonce))
+	}
+
+	hc := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			// Talking to ourselves over loopback; the certificate may be self-signed
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "not ready: HTTP %d\n", resp.StatusCode)
+		return 1
+	}
+	return 0
+}
@@ -89,3 +89,44 @@ func (s *SessionTracker) Snapshot() *SessionInfo {
 		TotalDownloadBytes: s.lastDownload,
 	}
 }
+
+// SessionState is the persisted form of a SessionTracker, so session
+// aggregates survive agent restarts (see Store.SaveSession).
+type SessionState struct {
+	StartTime    int64   `json:"start_time"`
+	PeakConns    int64   `json:"peak_connections"`
+	SampleCount  int64   `json:"sample_count"`
+	ConnSum      int64   `json:"conn_sum"`
+	LastUpload   float64 `json:"last_upload"`
+	LastDownload float64 `json:"last_download"`
+}
+
+// State returns the tracker's internal state for persistence.
+func (s *SessionTracker) State() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SessionState{
+		StartTime:    s.startTime.Unix(),
+		PeakConns:    s.peakConns,
+		SampleCount:  s.sampleCount,
+		ConnSum:      s.connSum,
+		LastUpload:   s.lastUpload,
+		LastDownload: s.lastDownload,
+	}
+}
+
+// Restore replaces the tracker's state with a previously persisted one.
+// If the containers restarted while the agent was down, the next Update
+// sees the traffic counters drop and resets the session as usual.
+func (s *SessionTracker) Restore(state SessionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startTime = time.Unix(state.StartTime, 0)
+	s.peakConns = state.PeakConns
+	s.sampleCount = state.SampleCount
+	s.connSum = state.ConnSum
+	s.lastUpload = state.LastUpload
+	s.lastDownload = state.LastDownload
+}
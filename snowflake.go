@@ -5,7 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -16,7 +16,9 @@ import (
 // proxy containers running on the host. Snowflake containers expose metrics
 // on host ports starting at 10000 (snowflake-1 → 10000, snowflake-2 → 9999).
 // Since conduit-expose runs with --network=host, it can access these directly.
-func collectSnowflakeMetrics(ctx context.Context, cfg *Config) *SnowflakeMetrics {
+// It returns nil metrics if no proxy could be scraped, and an error for every
+// proxy that failed.
+func collectSnowflakeMetrics(ctx context.Context, cfg *Config) (*SnowflakeMetrics, []*snowflakeScrapeError) {
 	snowflakeCount := 1
 	if cfg != nil {
 		// The caller already checked settings; default to 1 container
@@ -30,6 +32,7 @@ func collectSnowflakeMetrics(ctx context.Context, cfg *Config) *SnowflakeMetrics
 
 	aggregated := &SnowflakeMetrics{}
 	found := false
+	var failures []*snowflakeScrapeError
 
 	for i := 1; i <= snowflakeCount; i++ {
 		port := 10001 - i // snowflake-1 → 10000, snowflake-2 → 9999
@@ -37,7 +40,9 @@ func collectSnowflakeMetrics(ctx context.Context, cfg *Config) *SnowflakeMetrics
 
 		metrics, err := scrapeSnowflakePrometheus(ctx, addr)
 		if err != nil {
-			log.Printf("WARN: snowflake-%d metrics unavailable at %s: %v", i, addr, err)
+			instance := fmt.Sprintf("snowflake-%d", i)
+			slog.Warn("snowflake metrics unavailable", "instance", instance, "stage", stageSnowflake, "url", addr, "error", err)
+			failures = append(failures, &snowflakeScrapeError{Instance: instance, Err: err})
 			continue
 		}
 
@@ -49,12 +54,25 @@ func collectSnowflakeMetrics(ctx context.Context, cfg *Config) *SnowflakeMetrics
 	}
 
 	if !found {
-		return nil
+		return nil, failures
 	}
 
-	return aggregated
+	return aggregated, failures
 }
 
+// snowflakeScrapeError reports a snowflake proxy whose metrics endpoint
+// could not be scraped.
+type snowflakeScrapeError struct {
+	Instance string // e.g. snowflake-2
+	Err      error
+}
+
+func (e *snowflakeScrapeError) Error() string {
+	return e.Instance + " scrape failed: " + e.Err.Error()
+}
+
+func (e *snowflakeScrapeError) Unwrap() error { return e.Err }
+
 // scrapeSnowflakePrometheus fetches and parses Prometheus text format from
 // a single snowflake container.
 func scrapeSnowflakePrometheus(ctx context.Context, addr string) (*SnowflakeMetrics, error) {
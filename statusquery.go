@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ============================================================
+// /status query parameters
+// ============================================================
+//
+//	fields=system,session,containers.app_metrics   keep only these paths
+//	container=conduit-1,a1b2c3d4                   keep only these containers
+//	top_countries=10                               truncate the country lists
+//	compact=1                                      short keys, zero values dropped
+//
+// The cached StatusResponse is never modified; filters work on a copy.
+
+// statusQuery holds the parsed /status query parameters.
+type statusQuery struct {
+	fields       fieldTree
+	containers   []string
+	topCountries int // 0 = all
+	compact      bool
+}
+
+// fieldTree is a parsed fields= selection. A nil subtree selects the whole value.
+type fieldTree map[string]fieldTree
+
+// statusAlwaysFields are kept by every fields= selection so filtered
+// responses can still be told apart.
+var statusAlwaysFields = []string{"api_version", "server_id", "timestamp"}
+
+// containerAlwaysFields are kept in every container of a fields= selection.
+var containerAlwaysFields = []string{"id", "name"}
+
+func parseStatusQuery(q url.Values) (*statusQuery, error) {
+	sq := &statusQuery{}
+
+	if v := q.Get("fields"); v != "" {
+		sq.fields = fieldTree{}
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				sq.fields.add(strings.Split(f, "."))
+			}
+		}
+	}
+
+	for _, c := range strings.Split(q.Get("container"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			sq.containers = append(sq.containers, c)
+		}
+	}
+
+	if v := q.Get("top_countries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid 'top_countries': %q", v)
+		}
+		sq.topCountries = n
+	}
+
+	if v := q.Get("compact"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'compact': %q", v)
+		}
+		sq.compact = b
+	}
+
+	return sq, nil
+}
+
+// add inserts a dotted path. Selecting a parent after a child (or vice
+// versa) selects the whole parent.
+func (t fieldTree) add(path []string) {
+	key := path[0]
+	sub, exists := t[key]
+	if len(path) == 1 || (exists && sub == nil) {
+		t[key] = nil
+		return
+	}
+	if sub == nil {
+		sub = fieldTree{}
+		t[key] = sub
+	}
+	sub.add(path[1:])
+}
+
+// IsZero reports whether the query leaves the response untouched.
+func (sq *statusQuery) IsZero() bool {
+	return sq.fields == nil && len(sq.containers) == 0 && sq.topCountries == 0 && !sq.compact
+}
+
+// Apply returns resp with the query applied, ready for JSON encoding in the
+// shape of the given API version.
+func (sq *statusQuery) Apply(resp *StatusResponse, version string) (any, error) {
+	filtered := *resp
+
+	if len(sq.containers) > 0 {
+		filtered.Containers = make([]ContainerInfo, 0, len(sq.containers))
+		for _, c := range resp.Containers {
+			if sq.matchContainer(c) {
+				filtered.Containers = append(filtered.Containers, c)
+			}
+		}
+	}
+
+	if n := sq.topCountries; n > 0 {
+		if len(filtered.ClientsByCountry) > n {
+			filtered.ClientsByCountry = filtered.ClientsByCountry[:n]
+		}
+		if len(filtered.TrafficByCountry) > n {
+			filtered.TrafficByCountry = filtered.TrafficByCountry[:n]
+		}
+	}
+
+	versionSel := versionFields(reflect.TypeOf(resp), version)
+	if sq.fields == nil && !sq.compact && versionSel == nil {
+		return &filtered, nil
+	}
+
+	// Field selection and key rewriting work on the generic JSON form, so
+	// they cover every field without per-type code.
+	data, err := json.Marshal(&filtered)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+
+	var out any = tree
+	if versionSel != nil {
+		out = selectFields(out, versionSel)
+	}
+	if sq.fields != nil {
+		sel := fieldTree{}
+		for k, v := range sq.fields {
+			sel[k] = v
+		}
+		for _, f := range statusAlwaysFields {
+			sel[f] = nil
+		}
+		if sub := sel["containers"]; sub != nil {
+			for _, f := range containerAlwaysFields {
+				sub[f] = nil
+			}
+		}
+		out = selectFields(out, sel)
+	}
+	if sq.compact {
+		out = compactValue(out)
+	}
+	return out, nil
+}
+
+// matchContainer reports whether c is named by one of the container= values,
+// either by exact name or by ID prefix.
+func (sq *statusQuery) matchContainer(c ContainerInfo) bool {
+	for _, ref := range sq.containers {
+		if c.Name == ref || (len(ref) >= minContainerIDPrefix && strings.HasPrefix(c.ID, ref)) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectFields keeps only the selected keys of objects, applying the
+// selection to every element of arrays.
+func selectFields(v any, sel fieldTree) any {
+	if sel == nil {
+		return v
+	}
+	switch val := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(sel))
+		for k, sub := range sel {
+			if child, ok := val[k]; ok {
+				out[k] = selectFields(child, sub)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, e := range val {
+			out[i] = selectFields(e, sel)
+		}
+		return out
+	}
+	return v
+}
+
+// compactKeys maps JSON keys to the short names used by compact=1. The
+// mapping is one-to-one; keys not listed (including map keys such as TCP
+// state names) are left as they are.
+var compactKeys = map[string]string{
+	// StatusResponse
+	"api_version":        "v",
+	"server_id":          "sid",
+	"timestamp":          "ts",
+	"total_containers":   "tc",
+	"connected_clients":  "cc",
+	"connecting_clients": "cg",
+	"system":             "sys",
+	"settings":           "set",
+	"session":            "ses",
+	"connections":        "conn",
+	"clients_by_country": "cbc",
+	"traffic_by_country": "tbc",
+	"snowflake":          "sf",
+	"containers":         "ctr",
+	"cm_available":       "cm",
+	"warnings":           "w",
+
+	// SystemMetrics
+	"cpu_percent":     "cpu",
+	"memory_used_mb":  "mu",
+	"memory_total_mb": "mt",
+	"load_avg_1m":     "l1",
+	"load_avg_5m":     "l5",
+	"load_avg_15m":    "l15",
+	"disk_used_gb":    "du",
+	"disk_total_gb":   "dt",
+	"net_in_mbps":     "ni",
+	"net_out_mbps":    "no",
+	"net_errors":      "ne",
+	"net_drops":       "nd",
+
+	// ContainerSettings
+	"max_clients":          "mc",
+	"bandwidth_limit_mbps": "bw",
+	"auto_start":           "as",
+	"container_count":      "cn",
+	"snowflake_enabled":    "sfe",
+	"snowflake_count":      "sfc",
+
+	// SessionInfo
+	"start_time":           "st",
+	"peak_connections":     "pk",
+	"avg_connections":      "avg",
+	"total_upload_bytes":   "tu",
+	"total_download_bytes": "td",
+
+	// ConnectionStats
+	"total":      "t",
+	"unique_ips": "ui",
+	"states":     "s",
+
+	// CountryStats, CountryTrafficStats
+	"country":    "c",
+	"from_bytes": "fb",
+	"to_bytes":   "tb",
+
+	// SnowflakeMetrics
+	"total_connections": "tcn",
+	"timeouts_total":    "to",
+	"inbound_bytes":     "ib",
+	"outbound_bytes":    "ob",
+
+	// ContainerInfo
+	"name":        "nm",
+	"status":      "stt",
+	"memory_mb":   "mem",
+	"uptime":      "up",
+	"health":      "h",
+	"app_metrics": "am",
+	"errors":      "err",
+
+	// StatusIssue
+	"code":       "cd",
+	"message":    "msg",
+	"first_seen": "fs",
+
+	// ContainerHealth
+	"restart_count": "rc",
+	"oom_killed":    "oom",
+	"fd_count":      "fd",
+	"thread_count":  "thr",
+
+	// AppMetrics
+	"announcing":       "an",
+	"is_live":          "live",
+	"bytes_uploaded":   "bu",
+	"bytes_downloaded": "bd",
+	"uptime_seconds":   "us",
+	"idle_seconds":     "is",
+}
+
+// compactValue shortens object keys and drops zero values (0, false, "",
+// null, empty objects and arrays) from objects. Array elements are kept so
+// positions don't shift.
+func compactValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, child := range val {
+			child = compactValue(child)
+			if isZeroJSON(child) {
+				continue
+			}
+			if short, ok := compactKeys[k]; ok {
+				k = short
+			}
+			out[k] = child
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, e := range val {
+			out[i] = compactValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+func isZeroJSON(v any) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !val
+	case float64:
+		return val == 0
+	case string:
+		return val == ""
+	case map[string]any:
+		return len(val) == 0
+	case []any:
+		return len(val) == 0
+	}
+	return false
+}
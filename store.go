@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Persistent History Store
+// ============================================================
+//
+// Samples are appended as one JSON object per line to three tier files under
+// <data dir>/history/:
+//
+//	raw.jsonl  every poll result, kept 48h
+//	5m.jsonl   5-minute rollups (avg + min/max), kept 30 days
+//	1h.jsonl   hourly rollups, kept 365 days
+//
+// Each record is written with a single write call and fsynced. A crash can at
+// worst leave a partial last line, which safeReadLines discards on read.
+// Compaction rewrites each tier without expired records into a temp file and
+// renames it into place, so a tier file is never half-compacted. After
+// OpenStore it runs hourly in the background; st.mu is only held to snapshot
+// a tier and to swap in the rewritten file.
+
+const (
+	storeCompactInterval = time.Hour
+	storeSessionFile     = "session.json"
+	storeMaxRecordBytes  = 16 << 20
+)
+
+// storeTierSpecs defines the on-disk tiers, finest first.
+var storeTierSpecs = []struct {
+	name      string
+	step      int64 // rollup bucket in seconds; 0 = raw samples
+	retention time.Duration
+}{
+	{"raw", 0, 48 * time.Hour},
+	{"5m", 300, 30 * 24 * time.Hour},
+	{"1h", 3600, 365 * 24 * time.Hour},
+}
+
+// storeTier is one append-only tier file.
+type storeTier struct {
+	name      string
+	step      int64
+	retention time.Duration
+	path      string
+	file      *os.File
+	acc       *rollupAcc // open bucket for rollup tiers
+}
+
+// rollupAcc accumulates raw samples for one rollup bucket.
+type rollupAcc struct {
+	bucket int64
+	sum    map[string]float64
+	n      map[string]int
+	min    map[string]float64
+	max    map[string]float64
+}
+
+func newRollupAcc(bucket int64) *rollupAcc {
+	return &rollupAcc{
+		bucket: bucket,
+		sum:    make(map[string]float64),
+		n:      make(map[string]int),
+		min:    make(map[string]float64),
+		max:    make(map[string]float64),
+	}
+}
+
+func (a *rollupAcc) add(s HistorySample) {
+	for name, v := range s.Values {
+		if a.n[name] == 0 {
+			a.min[name] = v
+			a.max[name] = v
+		} else {
+			a.min[name] = math.Min(a.min[name], v)
+			a.max[name] = math.Max(a.max[name], v)
+		}
+		a.sum[name] += v
+		a.n[name]++
+	}
+}
+
+func (a *rollupAcc) sample() HistorySample {
+	avg := make(map[string]float64, len(a.sum))
+	for name, sum := range a.sum {
+		avg[name] = sum / float64(a.n[name])
+	}
+	return HistorySample{Timestamp: a.bucket, Values: avg, Min: a.min, Max: a.max}
+}
+
+// Store persists history samples and session state in a data directory.
+type Store struct {
+	mu          sync.Mutex
+	dir         string
+	tiers       []*storeTier
+	lastCompact time.Time
+	compacting  bool
+	closed      bool
+}
+
+// OpenStore opens (creating if needed) the store in dir, compacts it, and
+// rebuilds the in-progress rollup buckets from the raw tier.
+func OpenStore(dir string) (*Store, error) {
+	historyDir := filepath.Join(dir, "history")
+	if err := os.MkdirAll(historyDir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+
+	st := &Store{dir: dir}
+	for _, spec := range storeTierSpecs {
+		st.tiers = append(st.tiers, &storeTier{
+			name:      spec.name,
+			step:      spec.step,
+			retention: spec.retention,
+			path:      filepath.Join(historyDir, spec.name+".jsonl"),
+		})
+	}
+
+	now := time.Now()
+	if err := st.compact(now); err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastCompact = now
+
+	// Replay raw samples that belong to rollup buckets not yet written, so a
+	// restart doesn't leave holes in the 5m/1h tiers.
+	raw := readStoreSamples(st.tiers[0].path)
+	for _, t := range st.tiers[1:] {
+		var last int64 = -1
+		if samples := readStoreSamples(t.path); len(samples) > 0 {
+			last = samples[len(samples)-1].Timestamp
+		}
+		for _, s := range raw {
+			if s.Timestamp-s.Timestamp%t.step > last {
+				if err := t.addRollup(s); err != nil {
+					slog.Warn("store: rebuilding rollup", "rollup", t.name, "error", err)
+				}
+			}
+		}
+	}
+
+	return st, nil
+}
+
+// Add records a poll result. It is meant to be passed to pollLoop as a hook.
+func (st *Store) Add(resp *StatusResponse) {
+	if err := st.AddSample(historySampleFromStatus(resp)); err != nil {
+		slog.Warn("store: write failed", "error", err)
+	}
+}
+
+// AddSample appends s to the raw tier and feeds it to the rollup tiers.
+func (st *Store) AddSample(s HistorySample) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := st.tiers[0].append(s); err != nil {
+		return fmt.Errorf("appending raw sample: %w", err)
+	}
+	for _, t := range st.tiers[1:] {
+		if err := t.addRollup(s); err != nil {
+			return fmt.Errorf("appending %s rollup: %w", t.name, err)
+		}
+	}
+
+	if now := time.Now(); !st.compacting && now.Sub(st.lastCompact) >= storeCompactInterval {
+		st.compacting = true
+		st.lastCompact = now
+		go func() {
+			if err := st.compact(now); err != nil {
+				slog.Warn("store: compaction failed", "error", err)
+			}
+			st.mu.Lock()
+			st.compacting = false
+			st.mu.Unlock()
+		}()
+	}
+	return nil
+}
+
+// addRollup adds a raw sample to the open bucket, first flushing the
+// previous bucket to disk if s starts a new one.
+func (t *storeTier) addRollup(s HistorySample) error {
+	bucket := s.Timestamp - s.Timestamp%t.step
+	if t.acc != nil && t.acc.bucket != bucket {
+		if err := t.append(t.acc.sample()); err != nil {
+			return err
+		}
+		t.acc = nil
+	}
+	if t.acc == nil {
+		t.acc = newRollupAcc(bucket)
+	}
+	t.acc.add(s)
+	return nil
+}
+
+// append writes one record and syncs it to disk.
+func (t *storeTier) append(s HistorySample) error {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := t.file.Write(line); err != nil {
+		return err
+	}
+	return t.file.Sync()
+}
+
+// Range returns stored samples with from <= timestamp <= to from the finest
+// tier whose retention still covers from.
+//
+// Only picking the tier and opening its file happen under st.mu, so a long
+// read doesn't hold up AddSample. The open file keeps its contents even if
+// compaction renames a new one into place, and reading no further than the
+// size seen under the lock skips a record being appended. Records are
+// appended in time order, so reading stops after to.
+func (st *Store) Range(from, to int64) []HistorySample {
+	st.mu.Lock()
+	age := time.Since(time.Unix(from, 0))
+	tier := st.tiers[len(st.tiers)-1]
+	for _, t := range st.tiers {
+		if age <= t.retention {
+			tier = t
+			break
+		}
+	}
+	f, err := os.Open(tier.path)
+	var size int64
+	if err == nil {
+		if fi, statErr := f.Stat(); statErr == nil {
+			size = fi.Size()
+		}
+	}
+	st.mu.Unlock()
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var out []HistorySample
+	sc := bufio.NewScanner(io.LimitReader(f, size))
+	sc.Buffer(make([]byte, 0, 64*1024), storeMaxRecordBytes)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if ts, ok := sampleTimestamp(line); ok {
+			if ts < from {
+				continue
+			}
+			if ts > to {
+				break
+			}
+		}
+		var s HistorySample
+		if err := json.Unmarshal(line, &s); err != nil || s.Values == nil {
+			continue // partial or corrupt line
+		}
+		if s.Timestamp > to {
+			break
+		}
+		if s.Timestamp >= from {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// sampleTimestamp reads the timestamp at the start of a record, where
+// json.Marshal writes it, without decoding the values.
+func sampleTimestamp(line []byte) (int64, bool) {
+	rest, ok := bytes.CutPrefix(line, []byte(`{"t":`))
+	if !ok {
+		return 0, false
+	}
+	end := bytes.IndexByte(rest, ',')
+	if end < 0 {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(string(rest[:end]), 10, 64)
+	return ts, err == nil
+}
+
+// compact rewrites every tier without expired or unreadable records. Only
+// one compaction runs at a time.
+func (st *Store) compact(now time.Time) error {
+	for _, t := range st.tiers {
+		if err := st.compactTier(t, now.Add(-t.retention).Unix()); err != nil {
+			return fmt.Errorf("compacting %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+// compactTier filters the records of t older than cutoff into a temp file
+// without holding st.mu, then under the lock copies over the records
+// appended in the meantime, renames the temp file into place and makes it
+// the append handle.
+func (st *Store) compactTier(t *storeTier, cutoff int64) error {
+	st.mu.Lock()
+	src, err := os.OpenFile(t.path, os.O_RDONLY|os.O_CREATE, 0o600)
+	var size int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = src.Stat(); err == nil {
+			size = fi.Size()
+		} else {
+			src.Close()
+		}
+	}
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), "."+filepath.Base(t.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	sc := bufio.NewScanner(io.LimitReader(src, size))
+	sc.Buffer(make([]byte, 0, 64*1024), storeMaxRecordBytes)
+	for sc.Scan() {
+		line := sc.Bytes()
+		var s HistorySample
+		if err := json.Unmarshal(line, &s); err != nil || s.Values == nil || s.Timestamp < cutoff {
+			continue // expired, partial or corrupt
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil
+	}
+	// Only compaction renames tier files, so src is still the live file and
+	// everything past size was appended since the snapshot.
+	if _, err := src.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return err
+	}
+	swapped = true
+	syncDir(filepath.Dir(t.path))
+
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file = tmp
+	return nil
+}
+
+// SaveSession persists the session tracker state.
+func (st *Store) SaveSession(state SessionState) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(st.dir, storeSessionFile), data, 0o600); err != nil {
+		slog.Warn("store: saving session", "error", err)
+	}
+}
+
+// LoadSession returns the last persisted session state, if any.
+func (st *Store) LoadSession() (SessionState, bool) {
+	var state SessionState
+	data, err := os.ReadFile(filepath.Join(st.dir, storeSessionFile))
+	if err != nil {
+		return state, false
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Warn("store: ignoring unreadable file", "file", storeSessionFile, "error", err)
+		return state, false
+	}
+	return state, true
+}
+
+// Close closes the tier files. Open rollup buckets are not flushed; they are
+// rebuilt from the raw tier on the next OpenStore.
+func (st *Store) Close() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.closed = true
+	for _, t := range st.tiers {
+		if t.file != nil {
+			t.file.Close()
+			t.file = nil
+		}
+	}
+}
+
+func (st *Store) closeLocked() {
+	st.closed = true
+	for _, t := range st.tiers {
+		if t.file != nil {
+			t.file.Close()
+			t.file = nil
+		}
+	}
+}
+
+// readStoreSamples reads a tier file, skipping partial or corrupt lines.
+func readStoreSamples(path string) []HistorySample {
+	lines := safeReadLines(path)
+	samples := make([]HistorySample, 0, len(lines))
+	for _, line := range lines {
+		var s HistorySample
+		if err := json.Unmarshal([]byte(line), &s); err != nil || s.Values == nil {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// writeFileAtomic writes data to a temp file in the same directory, syncs it
+// and renames it over path, so readers see either the old or new contents.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	syncDir(dir)
+	return nil
+}
+
+// syncDir persists renames in dir.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// streamResumeDepth is how many recent snapshots StatusCache keeps so that a
+// reconnecting stream client can catch up on what it missed.
+const streamResumeDepth = 16
+
+// StatusSubscriber receives every snapshot passed to StatusCache.Set.
+// C is closed when the subscriber falls behind (buffer full) or the cache
+// shuts down its subscribers.
+type StatusSubscriber struct {
+	C chan *StatusResponse
+}
+
+// Subscribe registers a new subscriber with a buffer of the given size.
+// It also returns the retained snapshots newer than since (Unix seconds),
+// oldest first, so callers can replay them before reading from C.
+func (c *StatusCache) Subscribe(since int64, buffer int) (*StatusSubscriber, []*StatusResponse) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &StatusSubscriber{C: make(chan *StatusResponse, buffer)}
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	if c.subscribers == nil {
+		c.subscribers = make(map[*StatusSubscriber]struct{})
+	}
+	c.subscribers[sub] = struct{}{}
+
+	var backlog []*StatusResponse
+	for _, r := range c.recent {
+		if r.Timestamp > since {
+			backlog = append(backlog, r)
+		}
+	}
+	return sub, backlog
+}
+
+// Unsubscribe removes a subscriber. It is safe to call more than once.
+func (c *StatusCache) Unsubscribe(sub *StatusSubscriber) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	if _, ok := c.subscribers[sub]; ok {
+		delete(c.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// CloseSubscribers disconnects every subscriber. Used on server shutdown so
+// long-lived streams don't hold up http.Server.Shutdown.
+func (c *StatusCache) CloseSubscribers() {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	for sub := range c.subscribers {
+		delete(c.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// publish records r for resume and delivers it to all subscribers without
+// blocking. Subscribers whose buffer is full are dropped; they reconnect
+// and resume from their last-seen timestamp.
+func (c *StatusCache) publish(r *StatusResponse) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	c.recent = append(c.recent, r)
+	if len(c.recent) > streamResumeDepth {
+		c.recent = c.recent[len(c.recent)-streamResumeDepth:]
+	}
+
+	for sub := range c.subscribers {
+		select {
+		case sub.C <- r:
+		default:
+			delete(c.subscribers, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// ============================================================
+// HTTP Handler (GET /stream)
+// ============================================================
+
+// streamWriteTimeout bounds a single event write so a stalled client
+// can't pin a goroutine forever.
+const streamWriteTimeout = 10 * time.Second
+
+// streamHandler pushes a StatusResponse to the client on every poll.
+// WebSocket upgrade requests get a WebSocket stream; everything else gets
+// Server-Sent Events. Clients resume with ?since=<unix> or, for SSE, the
+// standard Last-Event-ID header.
+func streamHandler(cache *StatusCache, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := parseStreamSince(r)
+
+		if isWebSocketUpgrade(r) {
+			serveStatusWebSocket(w, r, cache, cfg, since)
+			return
+		}
+		serveStatusSSE(w, r, cache, cfg, since)
+	}
+}
+
+// parseStreamSince returns the last-seen timestamp requested by the client,
+// or -1 to mean "send the current snapshot only".
+func parseStreamSince(r *http.Request) int64 {
+	v := r.URL.Query().Get("since")
+	if v == "" {
+		v = r.Header.Get("Last-Event-ID")
+	}
+	if v == "" {
+		return -1
+	}
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return ts
+}
+
+// initialSnapshots picks what to send right after subscribing: the replay
+// backlog when resuming, otherwise just the latest snapshot.
+func initialSnapshots(cache *StatusCache, since int64, backlog []*StatusResponse) []*StatusResponse {
+	if since >= 0 {
+		return backlog
+	}
+	if latest := cache.Get(); latest != nil {
+		return []*StatusResponse{latest}
+	}
+	return nil
+}
+
+// marshalStreamEvent encodes one stream event in the shape of version.
+func marshalStreamEvent(resp *StatusResponse, version string) ([]byte, error) {
+	v := *resp
+	v.APIVersion = version
+	return marshalVersioned(&v, version)
+}
+
+func serveStatusSSE(w http.ResponseWriter, r *http.Request, cache *StatusCache, cfg *Config, since int64) {
+	rc := http.NewResponseController(w)
+
+	sub, backlog := cache.Subscribe(since, cfg.StreamBuffer)
+	defer cache.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	version := requestAPIVersion(r)
+	send := func(resp *StatusResponse) error {
+		data, err := marshalStreamEvent(resp, version)
+		if err != nil {
+			return err
+		}
+		rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", resp.Timestamp, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	for _, resp := range initialSnapshots(cache, since, backlog) {
+		if err := send(resp); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(cfg.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case resp, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := send(resp); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func serveStatusWebSocket(w http.ResponseWriter, r *http.Request, cache *StatusCache, cfg *Config, since int64) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		slog.Warn("websocket upgrade failed", "ip", clientIP(r).String(), "error", err)
+		return
+	}
+	defer ws.Close()
+
+	sub, backlog := cache.Subscribe(since, cfg.StreamBuffer)
+	defer cache.Unsubscribe(sub)
+
+	// Reader: answers pings and notices when the client goes away.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			op, payload, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsOpPing:
+				ws.WriteMessage(wsOpPong, payload, streamWriteTimeout)
+			case wsOpClose:
+				return
+			}
+		}
+	}()
+
+	version := requestAPIVersion(r)
+	send := func(resp *StatusResponse) error {
+		data, err := marshalStreamEvent(resp, version)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(wsOpText, data, streamWriteTimeout)
+	}
+
+	for _, resp := range initialSnapshots(cache, since, backlog) {
+		if err := send(resp); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(cfg.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case resp, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := send(resp); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := ws.WriteMessage(wsOpPing, nil, streamWriteTimeout); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
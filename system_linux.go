@@ -3,10 +3,13 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"math"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func readDisk(rootPath string, m *SystemMetrics) {
@@ -16,7 +19,7 @@ func readDisk(rootPath string, m *SystemMetrics) {
 
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs(rootPath, &stat); err != nil {
-		log.Printf("WARN: failed to statfs %s: %v", rootPath, err)
+		slog.Warn("failed to statfs", "path", rootPath, "stage", stageSystem, "error", err)
 		return
 	}
 
@@ -24,3 +27,23 @@ func readDisk(rootPath string, m *SystemMetrics) {
 	m.DiskTotalGB = math.Round(float64(stat.Blocks*bsize)/1e9*100) / 100
 	m.DiskUsedGB = math.Round(float64((stat.Blocks-stat.Bfree)*bsize)/1e9*100) / 100
 }
+
+// readProcessUsage returns the CPU time used by this process and its
+// resident set size in bytes.
+func readProcessUsage() (time.Duration, uint64) {
+	var ru syscall.Rusage
+	var cpu time.Duration
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err == nil {
+		cpu = time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	}
+
+	// /proc/self/statm: size resident shared ... (in pages)
+	var rss uint64
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			rss = pages * uint64(os.Getpagesize())
+		}
+	}
+	return cpu, rss
+}
@@ -2,6 +2,13 @@
 
 package main
 
+import "time"
+
 func readDisk(rootPath string, m *SystemMetrics) {
 	// Disk metrics only available on Linux via syscall.Statfs
 }
+
+func readProcessUsage() (time.Duration, uint64) {
+	// Process CPU and RSS only available on Linux
+	return 0, 0
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ============================================================
+// TLS
+// ============================================================
+//
+// With CONDUIT_TLS=true the agent serves HTTPS. Unless a certificate is
+// provided via CONDUIT_TLS_CERT/CONDUIT_TLS_KEY, a self-signed one is
+// generated on first start and kept in <data dir>/tls so it survives
+// updates. Dashboards pin it by its SHA-256 fingerprint, which is written
+// to <data dir>/tls/fingerprint and appended to the conduit:// URI as
+// ?fp=<hex>, so no CA is involved.
+
+const (
+	tlsCertFile        = "cert.pem"
+	tlsKeyFile         = "key.pem"
+	tlsFingerprintFile = "fingerprint"
+	tlsCertValidity    = 10 * 365 * 24 * time.Hour
+)
+
+// loadOrCreateTLSCertificate returns the configured certificate, or the
+// persisted self-signed one, generating it if it doesn't exist yet.
+func loadOrCreateTLSCertificate(cfg *Config) (tls.Certificate, error) {
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return tls.Certificate{}, errors.New("CONDUIT_TLS_CERT and CONDUIT_TLS_KEY must be set together")
+		}
+		return tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+
+	dir := filepath.Join(cfg.DataDir, "tls")
+	certPath := filepath.Join(dir, tlsCertFile)
+	keyPath := filepath.Join(dir, tlsKeyFile)
+
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		return cert, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return tls.Certificate{}, fmt.Errorf("loading %s: %w", certPath, err)
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCert()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generating certificate: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return tls.Certificate{}, fmt.Errorf("creating %s: %w", dir, err)
+	}
+	// Key first: a crash in between leaves no cert, so we regenerate both.
+	if err := writeFileAtomic(keyPath, keyPEM, 0o600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("writing %s: %w", keyPath, err)
+	}
+	if err := writeFileAtomic(certPath, certPEM, 0o644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("writing %s: %w", certPath, err)
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateSelfSignedCert creates an ECDSA P-256 certificate. The subject is
+// deliberately generic so the certificate doesn't identify the agent.
+func generateSelfSignedCert() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(tlsCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// certFingerprint returns the lowercase hex SHA-256 of the leaf certificate (DER).
+func certFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// newServerTLSConfig loads the certificate, publishes its fingerprint for
+// the installer and returns the server TLS config along with the fingerprint.
+func newServerTLSConfig(cfg *Config) (*tls.Config, string, error) {
+	cert, err := loadOrCreateTLSCertificate(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fp := certFingerprint(cert)
+	fpPath := filepath.Join(cfg.DataDir, "tls", tlsFingerprintFile)
+	if err := os.MkdirAll(filepath.Dir(fpPath), 0o700); err != nil {
+		slog.Warn("tls: cannot write fingerprint", "path", fpPath, "error", err)
+	} else if err := writeFileAtomic(fpPath, []byte(fp+"\n"), 0o644); err != nil {
+		slog.Warn("tls: cannot write fingerprint", "path", fpPath, "error", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, fp, nil
+}
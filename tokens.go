@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================================
+// API Tokens
+// ============================================================
+
+// Scopes checked by authMiddleware. scopeAll grants every scope.
+const (
+	scopeStatusRead        = "status:read"
+	scopeHistoryRead       = "history:read"
+	scopeContainersRead    = "containers:read"
+	scopeContainersControl = "containers:control"
+	scopeNotifyTest        = "notify:test"
+	scopeAll               = "*"
+
+	masterTokenName = "master"
+	minTokenLength  = 16
+)
+
+var knownScopes = map[string]bool{
+	scopeStatusRead:        true,
+	scopeHistoryRead:       true,
+	scopeContainersRead:    true,
+	scopeContainersControl: true,
+	scopeNotifyTest:        true,
+	scopeAll:               true,
+}
+
+// apiToken is a credential accepted by the Authenticator. The master token
+// (CONDUIT_AUTH_SECRET) has every scope and never expires.
+type apiToken struct {
+	Name       string
+	secret     []byte
+	signingKey []byte
+	scopes     map[string]bool
+	expires    time.Time // zero = never
+	networks   []*net.IPNet
+}
+
+func newAPIToken(name, secret string, scopes []string) *apiToken {
+	t := &apiToken{
+		Name:       name,
+		secret:     []byte(secret),
+		signingKey: deriveSigningKey(secret),
+		scopes:     make(map[string]bool, len(scopes)),
+	}
+	for _, s := range scopes {
+		t.scopes[s] = true
+	}
+	return t
+}
+
+// Allows reports whether the token grants scope.
+func (t *apiToken) Allows(scope string) bool {
+	return t.scopes[scopeAll] || t.scopes[scope]
+}
+
+// Expired reports whether the token's expiry has passed.
+func (t *apiToken) Expired(now time.Time) bool {
+	return !t.expires.IsZero() && now.After(t.expires)
+}
+
+// AllowsIP reports whether ip may use the token. Tokens without CIDR
+// restrictions are usable from anywhere.
+func (t *apiToken) AllowsIP(ip net.IP) bool {
+	if len(t.networks) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenFileEntry is one entry of the tokens file.
+type tokenFileEntry struct {
+	Name    string     `json:"name"`
+	Token   string     `json:"token"`
+	Scopes  []string   `json:"scopes"`
+	Expires *time.Time `json:"expires,omitempty"`
+	CIDRs   []string   `json:"cidrs,omitempty"`
+}
+
+// tokenFile is the JSON document at CONDUIT_TOKENS_FILE.
+type tokenFile struct {
+	Tokens []tokenFileEntry `json:"tokens"`
+}
+
+// loadTokensFile parses and validates the tokens file. Any invalid entry
+// fails the whole load, so a typo can't silently drop or widen access.
+func loadTokensFile(path string) (map[string]*apiToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokenFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	tokens := make(map[string]*apiToken, len(file.Tokens))
+	for i, e := range file.Tokens {
+		if e.Name == "" {
+			return nil, fmt.Errorf("token #%d: missing name", i+1)
+		}
+		if e.Name == masterTokenName {
+			return nil, fmt.Errorf("token %q: name is reserved", e.Name)
+		}
+		if _, dup := tokens[e.Name]; dup {
+			return nil, fmt.Errorf("token %q: duplicate name", e.Name)
+		}
+		if len(e.Token) < minTokenLength {
+			return nil, fmt.Errorf("token %q: must be at least %d characters", e.Name, minTokenLength)
+		}
+		if len(e.Scopes) == 0 {
+			return nil, fmt.Errorf("token %q: no scopes", e.Name)
+		}
+		for _, s := range e.Scopes {
+			if !knownScopes[s] {
+				return nil, fmt.Errorf("token %q: unknown scope %q", e.Name, s)
+			}
+		}
+
+		t := newAPIToken(e.Name, e.Token, e.Scopes)
+		if e.Expires != nil {
+			t.expires = *e.Expires
+		}
+		for _, c := range e.CIDRs {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+			if err != nil {
+				return nil, fmt.Errorf("token %q: %w", e.Name, err)
+			}
+			t.networks = append(t.networks, n)
+		}
+		tokens[e.Name] = t
+	}
+	return tokens, nil
+}
+
+// watchTokensFile reloads the tokens file whenever its modification time or
+// size changes. A file that fails to load keeps the previous token set.
+func (a *Authenticator) watchTokensFile(ctx context.Context, path string, interval time.Duration) {
+	var lastMod time.Time
+	var lastSize int64 = -1
+	if fi, err := os.Stat(path); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+
+			tokens, err := loadTokensFile(path)
+			if err != nil {
+				slog.Warn("keeping previous tokens, reload failed", "path", path, "error", err)
+				continue
+			}
+			a.setTokens(tokens)
+			slog.Info("reloaded API tokens", "count", len(tokens), "path", path)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Outbound tunnel (CONDUIT_TUNNEL_URL)
+// ============================================================
+//
+// The agent dials out to the dashboard over a WebSocket and serves the API
+// over it, so the dashboard can reach agents that have no open port. The
+// handshake is signed like an inbound request (see auth.go) with the tunnel
+// secret. Each tunnelled request then goes through the same handler chain as
+// a local one, so it needs its own credentials and the path prefix. Rate
+// limits and lockouts apply to the client address the dashboard reports in
+// the frame (see Guard.Middleware), not to the dashboard's own.
+//
+// Frames are JSON (see TunnelFrame). Responses are sent in chunks of at
+// most tunnelChunkBytes, and flushed as the handler flushes, so /stream and
+// followed logs work. The connection is pinged every heartbeat and dropped
+// when nothing arrives for three; the agent then reconnects with backoff.
+
+const (
+	tunnelFrameRequest  = "request"
+	tunnelFrameCancel   = "cancel"
+	tunnelFrameResponse = "response"
+	tunnelFrameBody     = "body"
+	tunnelFrameEnd      = "end"
+
+	tunnelBackoffBase = time.Second
+	tunnelDialTimeout = 15 * time.Second
+	// tunnelStableAfter is how long a connection must last for the next
+	// reconnect to start again from tunnelBackoffBase.
+	tunnelStableAfter = time.Minute
+	tunnelChunkBytes  = 256 * 1024 // base64 keeps a frame well under wsMaxMessageBytes
+	tunnelMaxInflight = 32
+)
+
+var errTunnelClosed = errors.New("closed by dashboard")
+
+// tunnelPeerContextKey marks a tunnelled request; the value is the frame's
+// Peer.
+type tunnelPeerContextKey struct{}
+
+// Tunnel keeps a connection to the dashboard open and serves requests
+// arriving over it with handler.
+type Tunnel struct {
+	url        *url.URL
+	key        []byte
+	serverID   string
+	handler    http.Handler
+	tlsConfig  *tls.Config
+	heartbeat  time.Duration
+	backoffMax time.Duration
+}
+
+// NewTunnel returns the configured tunnel, or nil if CONDUIT_TUNNEL_URL is
+// not set.
+func NewTunnel(cfg *Config, serverID string, handler http.Handler) (*Tunnel, error) {
+	if cfg.TunnelURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.TunnelURL)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return nil, fmt.Errorf("CONDUIT_TUNNEL_URL must be a ws:// or wss:// URL, got %q", cfg.TunnelURL)
+	}
+	if cfg.TunnelHeartbeat <= 0 {
+		return nil, fmt.Errorf("CONDUIT_TUNNEL_HEARTBEAT must be positive")
+	}
+	if cfg.TunnelBackoffMax < tunnelBackoffBase {
+		return nil, fmt.Errorf("CONDUIT_TUNNEL_BACKOFF_MAX must be at least %s", tunnelBackoffBase)
+	}
+	secret := cfg.TunnelSecret
+	if secret == "" {
+		secret = cfg.AuthSecret
+	}
+
+	t := &Tunnel{
+		url:        u,
+		key:        deriveSigningKey(secret),
+		serverID:   serverID,
+		handler:    handler,
+		heartbeat:  cfg.TunnelHeartbeat,
+		backoffMax: cfg.TunnelBackoffMax,
+	}
+	if fp := strings.ToLower(strings.ReplaceAll(cfg.TunnelFingerprint, ":", "")); fp != "" {
+		if u.Scheme != "wss" {
+			return nil, fmt.Errorf("CONDUIT_TUNNEL_FINGERPRINT requires a wss:// URL")
+		}
+		t.tlsConfig = pinnedTLSConfig(fp)
+	}
+	return t, nil
+}
+
+// pinnedTLSConfig accepts exactly the certificate whose SHA-256 fingerprint
+// is fp, self-signed or not, like dashboards pinning the agent.
+func pinnedTLSConfig(fp string) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true, // replaced by the fingerprint check
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(fp)) != 1 {
+				return errors.New("certificate fingerprint mismatch")
+			}
+			return nil
+		},
+	}
+}
+
+// Run connects and reconnects until ctx is done.
+func (t *Tunnel) Run(ctx context.Context) {
+	failures := 0
+	for {
+		started := time.Now()
+		ws, err := t.dial(ctx)
+		if err == nil {
+			slog.Info("tunnel connected", "url", t.url.Redacted())
+			err = t.serve(ctx, ws)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) >= tunnelStableAfter {
+			failures = 0
+		}
+		failures++
+		wait := backoffDelay(tunnelBackoffBase, t.backoffMax, failures)
+		slog.Warn("tunnel disconnected", "url", t.url.Redacted(), "retry_in", wait.Round(time.Second).String(), "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// dial opens the WebSocket with a signed handshake.
+func (t *Tunnel) dial(ctx context.Context) (*wsConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tunnelDialTimeout)
+	defer cancel()
+
+	nonceBytes := make([]byte, 16)
+	rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	h := http.Header{}
+	h.Set("User-Agent", userAgent)
+	h.Set(headerServerID, t.serverID)
+	h.Set(headerTimestamp, ts)
+	h.Set(headerNonce, nonce)
+	h.Set(headerSignature, signRequest(t.key, http.MethodGet, t.url.RequestURI(), ts, nonce))
+	return dialWebSocket(ctx, t.url, h, t.tlsConfig)
+}
+
+// serve handles frames until the connection fails or ctx is done, then
+// cancels requests in flight and waits for them.
+func (t *Tunnel) serve(ctx context.Context, ws *wsConn) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(t.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ws.WriteMessage(wsOpPing, nil, streamWriteTimeout); err != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	inflight := make(map[uint64]context.CancelFunc)
+	remote := ws.conn.RemoteAddr().String()
+
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(3 * t.heartbeat))
+		op, payload, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case wsOpPing:
+			ws.WriteMessage(wsOpPong, payload, streamWriteTimeout)
+			continue
+		case wsOpClose:
+			return errTunnelClosed
+		case wsOpText, wsOpBinary:
+		default:
+			continue
+		}
+
+		var f TunnelFrame
+		if err := json.Unmarshal(payload, &f); err != nil {
+			slog.Warn("tunnel: invalid frame", "error", err)
+			continue
+		}
+		switch f.Type {
+		case tunnelFrameRequest:
+			mu.Lock()
+			if _, dup := inflight[f.ID]; dup {
+				mu.Unlock()
+				continue
+			}
+			if len(inflight) >= tunnelMaxInflight {
+				mu.Unlock()
+				w := &tunnelResponseWriter{ws: ws, id: f.ID, header: http.Header{}}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.finish()
+				continue
+			}
+			rctx, rcancel := context.WithCancel(ctx)
+			inflight[f.ID] = rcancel
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.handle(rctx, ws, &f, remote)
+				mu.Lock()
+				delete(inflight, f.ID)
+				mu.Unlock()
+				rcancel()
+			}()
+		case tunnelFrameCancel:
+			mu.Lock()
+			if c := inflight[f.ID]; c != nil {
+				c()
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// handle runs one tunnelled request through the handler.
+func (t *Tunnel) handle(ctx context.Context, ws *wsConn, f *TunnelFrame, remote string) {
+	w := &tunnelResponseWriter{ws: ws, id: f.ID, header: http.Header{}}
+	defer w.finish()
+
+	if !strings.HasPrefix(f.Path, "/") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	ctx = context.WithValue(ctx, tunnelPeerContextKey{}, f.Peer)
+	req, err := http.NewRequestWithContext(ctx, f.Method, f.Path, bytes.NewReader(f.Body))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	// As the server would set them; signatures cover RequestURI.
+	req.RequestURI = f.Path
+	req.RemoteAddr = remote
+	req.Host = t.url.Host
+	if f.Header != nil {
+		req.Header = http.Header(f.Header)
+	}
+	t.handler.ServeHTTP(w, req)
+}
+
+// tunnelResponseWriter sends a handler's response as tunnel frames. The
+// body is buffered up to tunnelChunkBytes or until the handler flushes.
+type tunnelResponseWriter struct {
+	ws     *wsConn
+	id     uint64
+	header http.Header
+	status int
+	sent   bool // response frame sent
+	buf    bytes.Buffer
+	err    error
+}
+
+func (w *tunnelResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *tunnelResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *tunnelResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	if w.buf.Len() >= tunnelChunkBytes {
+		if err := w.FlushError(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// FlushError sends the response frame if it hasn't been sent, and the
+// buffered body. http.ResponseController uses it for Flush.
+func (w *tunnelResponseWriter) FlushError() error {
+	w.WriteHeader(http.StatusOK)
+	for w.err == nil && (!w.sent || w.buf.Len() > 0) {
+		f := TunnelFrame{Type: tunnelFrameBody, ID: w.id, Body: w.buf.Next(tunnelChunkBytes)}
+		if !w.sent {
+			f.Type, f.Status, f.Header = tunnelFrameResponse, w.status, w.header
+			w.sent = true
+		}
+		w.err = w.send(&f)
+	}
+	return w.err
+}
+
+func (w *tunnelResponseWriter) Flush() {
+	w.FlushError()
+}
+
+// finish sends whatever is left and the end frame.
+func (w *tunnelResponseWriter) finish() {
+	if w.FlushError() == nil {
+		w.send(&TunnelFrame{Type: tunnelFrameEnd, ID: w.id})
+	}
+}
+
+func (w *tunnelResponseWriter) send(f *TunnelFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return w.ws.WriteMessage(wsOpText, data, streamWriteTimeout)
+}
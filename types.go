@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
 	"time"
 )
@@ -155,6 +156,216 @@ type ContainerInfo struct {
 	Health     *ContainerHealth   `json:"health,omitempty"`
 	AppMetrics *AppMetrics        `json:"app_metrics,omitempty"`
 	Settings   *ContainerSettings `json:"settings,omitempty"`
+	Errors     []StatusIssue      `json:"errors,omitempty" api:"v2"`
+}
+
+// ============================================================
+// Container Detail (GET /containers/{id})
+// ============================================================
+
+// ContainerDetail is the response for GET /containers/{id}: the container's
+// entry from /status plus extended inspect data gathered on request.
+type ContainerDetail struct {
+	APIVersion string `json:"api_version"`
+	ContainerInfo
+	Inspect       *ContainerInspectInfo `json:"inspect,omitempty"`
+	LastStatsLine string                `json:"last_stats_line,omitempty"`
+	Connections   *ConnectionStats      `json:"connections,omitempty"`
+}
+
+// ContainerInspectInfo holds the subset of Docker inspect data useful for
+// troubleshooting a single node.
+type ContainerInspectInfo struct {
+	Image         string           `json:"image"`
+	ImageID       string           `json:"image_id"`
+	ImageDigest   string           `json:"image_digest,omitempty"`
+	RestartPolicy string           `json:"restart_policy"`
+	StartedAt     string           `json:"started_at,omitempty"`
+	FinishedAt    string           `json:"finished_at,omitempty"`
+	ExitCode      int              `json:"exit_code"`
+	PID           int              `json:"pid"`
+	Limits        ContainerLimits  `json:"limits"`
+	Mounts        []ContainerMount `json:"mounts"`
+	NetworkMode   string           `json:"network_mode"`
+}
+
+// ContainerLimits holds resource limits from the container's HostConfig.
+// Zero means unlimited.
+type ContainerLimits struct {
+	MemoryBytes int64   `json:"memory_bytes"`
+	CPUs        float64 `json:"cpus"`
+	CPUShares   int64   `json:"cpu_shares"`
+	PidsLimit   int64   `json:"pids_limit"`
+}
+
+// ContainerMount describes a single mount point.
+type ContainerMount struct {
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"read_only"`
+}
+
+// ============================================================
+// Container Logs (GET /containers/{id}/logs?format=ndjson)
+// ============================================================
+
+// ContainerLogLine is one line of NDJSON log output.
+type ContainerLogLine struct {
+	Timestamp string `json:"timestamp"` // RFC 3339 with nanoseconds, from Docker
+	Stream    string `json:"stream"`    // stdout or stderr
+	Line      string `json:"line"`
+}
+
+// ============================================================
+// Container Control (POST /containers/{id}/{action})
+// ============================================================
+
+// ContainerActionResponse is the result of a control request. When stop
+// needs confirmation, Status is "confirm_required" and the request must be
+// repeated with ?confirm=<Confirm> before ConfirmExpires.
+type ContainerActionResponse struct {
+	APIVersion     string `json:"api_version"`
+	Action         string `json:"action"`
+	Container      string `json:"container"`
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Confirm        string `json:"confirm,omitempty"`
+	ConfirmExpires int64  `json:"confirm_expires,omitempty"`
+}
+
+// ============================================================
+// Push (POST to CONDUIT_PUSH_URLS)
+// ============================================================
+
+// PushBatch is the body the agent POSTs to a collector in push mode.
+// Snapshots are StatusResponses, oldest first; server_id and each
+// snapshot's timestamp identify a snapshot if a retry delivers it twice.
+type PushBatch struct {
+	APIVersion string            `json:"api_version"`
+	ServerID   string            `json:"server_id"`
+	SentAt     int64             `json:"sent_at"`
+	Snapshots  []json.RawMessage `json:"snapshots"`
+}
+
+// ============================================================
+// Tunnel (CONDUIT_TUNNEL_URL)
+// ============================================================
+
+// TunnelFrame is one WebSocket text message on the outbound tunnel. The
+// dashboard sends "request" and "cancel" frames; the agent answers each
+// request with a "response" frame, zero or more "body" frames and an "end"
+// frame, all carrying the request's id. Body is base64 in JSON.
+type TunnelFrame struct {
+	Type   string              `json:"type"`
+	ID     uint64              `json:"id"`
+	Method string              `json:"method,omitempty"`
+	Path   string              `json:"path,omitempty"`
+	Header map[string][]string `json:"header,omitempty"`
+	Status int                 `json:"status,omitempty"`
+	Body   []byte              `json:"body,omitempty"`
+	Peer   string              `json:"peer,omitempty"` // request: client IP the dashboard received it from
+}
+
+// ============================================================
+// Alerts (GET /alerts)
+// ============================================================
+
+// AlertRule is one rule of the rules file (CONDUIT_ALERT_RULES_FILE).
+type AlertRule struct {
+	Name     string `json:"name"`
+	Expr     string `json:"expr"`
+	For      string `json:"for,omitempty"`      // Go duration the condition must hold before firing
+	Severity string `json:"severity,omitempty"` // info, warning (default) or critical
+	Summary  string `json:"summary,omitempty"`
+}
+
+// Alert is one alert instance: a rule, and for containers.* rules a container.
+type Alert struct {
+	Rule        string   `json:"rule"`
+	Container   string   `json:"container,omitempty"`
+	State       string   `json:"state"` // pending, firing or resolved
+	Severity    string   `json:"severity"`
+	Summary     string   `json:"summary,omitempty"`
+	Expr        string   `json:"expr"`
+	Value       *float64 `json:"value,omitempty"` // left side of the rule's comparison, at the last evaluation
+	ActiveSince int64    `json:"active_since"`
+	FiredAt     int64    `json:"fired_at,omitempty"`
+	ResolvedAt  int64    `json:"resolved_at,omitempty"`
+}
+
+// AlertsResponse is the JSON response for GET /alerts.
+type AlertsResponse struct {
+	APIVersion  string      `json:"api_version"`
+	EvaluatedAt int64       `json:"evaluated_at"`
+	Alerts      []Alert     `json:"alerts"`
+	Rules       []AlertRule `json:"rules"`
+}
+
+// NotifyWebhookPayload is the default body POSTed to
+// CONDUIT_NOTIFY_WEBHOOK_URL when an alert fires or resolves.
+type NotifyWebhookPayload struct {
+	ServerID string `json:"server_id"`
+	Text     string `json:"text"` // rendered CONDUIT_NOTIFY_TEMPLATE
+	Test     bool   `json:"test,omitempty"`
+	Alert    Alert  `json:"alert"`
+}
+
+// NotifyResult is the outcome of a test notification on one channel.
+type NotifyResult struct {
+	Channel string `json:"channel"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NotifyTestResponse is the JSON response for POST /notify/test.
+type NotifyTestResponse struct {
+	APIVersion string         `json:"api_version"`
+	Results    []NotifyResult `json:"results"`
+}
+
+// AuditEntry is one line of the control audit log.
+type AuditEntry struct {
+	Time        int64  `json:"time"`
+	Token       string `json:"token"`
+	RemoteAddr  string `json:"remote_addr"`
+	Action      string `json:"action"`
+	Container   string `json:"container"`
+	ContainerID string `json:"container_id,omitempty"`
+	Result      string `json:"result"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ============================================================
+// History (GET /history)
+// ============================================================
+
+// HistorySample is one poll result flattened into named series values.
+// Rollup samples from the on-disk store carry the bucket average in Values
+// and the extremes in Min/Max.
+type HistorySample struct {
+	Timestamp int64              `json:"t"`
+	Values    map[string]float64 `json:"v"`
+	Min       map[string]float64 `json:"min,omitempty"`
+	Max       map[string]float64 `json:"max,omitempty"`
+}
+
+// HistoryPoint is one downsampled bucket of a series.
+type HistoryPoint struct {
+	Timestamp int64   `json:"t"` // bucket start (Unix seconds)
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Avg       float64 `json:"avg"`
+	Count     int     `json:"n"`
+}
+
+// HistoryResponse is the JSON response for GET /history.
+type HistoryResponse struct {
+	APIVersion string                    `json:"api_version"`
+	From       int64                     `json:"from"`
+	To         int64                     `json:"to"`
+	Step       int64                     `json:"step"`
+	Series     map[string][]HistoryPoint `json:"series"`
 }
 
 // ============================================================
@@ -163,6 +374,7 @@ type ContainerInfo struct {
 
 // StatusResponse is the top-level JSON response for GET /status.
 type StatusResponse struct {
+	APIVersion        string              `json:"api_version"`
 	ServerID          string              `json:"server_id"`
 	Timestamp         int64               `json:"timestamp"`
 	TotalContainers   int                 `json:"total_containers"`
@@ -177,6 +389,112 @@ type StatusResponse struct {
 	Snowflake         *SnowflakeMetrics   `json:"snowflake,omitempty"`
 	Containers        []ContainerInfo     `json:"containers"`
 	CMAvailable       bool                `json:"cm_available"`
+	Warnings          []StatusIssue       `json:"warnings,omitempty" api:"v2"`
+}
+
+// StatusIssue explains missing or degraded data in a StatusResponse: a
+// container's errors or a host-wide warning. Code is stable and meant for
+// programs; Message is for people and may change between polls.
+type StatusIssue struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	FirstSeen int64  `json:"first_seen"` // Unix time the issue started, kept while it persists
+}
+
+// ============================================================
+// Collector Diagnostics (GET /debug/collector)
+// ============================================================
+
+// CollectorDiagnostics describes how the collector itself is doing: poll
+// and per-stage timings, errors and the agent's own resource usage.
+type CollectorDiagnostics struct {
+	APIVersion    string             `json:"api_version"`
+	UptimeSeconds float64            `json:"uptime_seconds"`
+	Polls         PollDiagnostics    `json:"polls"`
+	Stages        []StageDiagnostics `json:"stages"`
+	Containers    []ContainerTimings `json:"containers"`
+	Process       ProcessDiagnostics `json:"process"`
+	Guard         GuardStats         `json:"guard"`
+}
+
+// PollDiagnostics summarizes completed poll cycles.
+type PollDiagnostics struct {
+	Count              int64             `json:"count"`
+	Errors             int64             `json:"errors"`
+	LastAt             int64             `json:"last_at,omitempty"`
+	LastSuccessAt      int64             `json:"last_success_at,omitempty"`
+	LastError          string            `json:"last_error,omitempty"`
+	LastDurationMs     float64           `json:"last_duration_ms"`
+	RunningSeconds     float64           `json:"running_seconds,omitempty"` // age of the poll in progress
+	DurationSumSeconds float64           `json:"duration_sum_seconds"`
+	Histogram          []HistogramBucket `json:"histogram"`
+}
+
+// HistogramBucket counts polls that took at most LE seconds (cumulative).
+type HistogramBucket struct {
+	LE    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+// StageDiagnostics holds timings and errors of one collectAll stage since
+// start. Per-container stages count one observation per container.
+type StageDiagnostics struct {
+	Stage       string  `json:"stage"`
+	Count       int64   `json:"count"`
+	Errors      int64   `json:"errors"`
+	LastMs      float64 `json:"last_ms"`
+	AvgMs       float64 `json:"avg_ms"`
+	MaxMs       float64 `json:"max_ms"`
+	LastError   string  `json:"last_error,omitempty"`
+	LastErrorAt int64   `json:"last_error_at,omitempty"`
+}
+
+// ContainerTimings holds one container's stage durations in the last poll.
+type ContainerTimings struct {
+	Name     string             `json:"name"`
+	StagesMs map[string]float64 `json:"stages_ms"`
+}
+
+// ProcessDiagnostics is the agent's own resource usage.
+type ProcessDiagnostics struct {
+	CPUPercent float64 `json:"cpu_percent"` // over the last poll interval
+	CPUSeconds float64 `json:"cpu_seconds"`
+	RSSMB      float64 `json:"rss_mb"`
+	HeapMB     float64 `json:"heap_mb"`
+	Goroutines int     `json:"goroutines"`
+	GCCycles   uint32  `json:"gc_cycles"`
+}
+
+// ============================================================
+// Health and errors
+// ============================================================
+
+// HealthResponse is the JSON response for GET /health.
+type HealthResponse struct {
+	APIVersion string `json:"api_version"`
+	Status     string `json:"status"`
+}
+
+// ReadyResponse is the JSON response for GET /ready. Checks are only
+// included in the authenticated /ready/details variant.
+type ReadyResponse struct {
+	APIVersion string       `json:"api_version"`
+	Status     string       `json:"status"` // "ready" or "not_ready"
+	Checks     []ReadyCheck `json:"checks,omitempty"`
+}
+
+// ReadyCheck is the outcome of one readiness check. Only failing required
+// checks make the agent not ready.
+type ReadyCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"` // "ok", "fail", "warn" or "skipped"
+	Required bool   `json:"required"`
+	Message  string `json:"message,omitempty"`
+}
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error string `json:"error"`
 }
 
 // ============================================================
@@ -184,9 +502,15 @@ type StatusResponse struct {
 // ============================================================
 
 // StatusCache provides thread-safe access to the latest StatusResponse.
+// It also fans out every new snapshot to stream subscribers (see stream.go).
 type StatusCache struct {
 	mu       sync.RWMutex
 	response *StatusResponse
+	snapshots map[string]*statusSnapshot // response serialized once per poll, by API version
+
+	subMu       sync.Mutex
+	subscribers map[*StatusSubscriber]struct{}
+	recent      []*StatusResponse // last few snapshots, for stream resume
 }
 
 func (c *StatusCache) Get() *StatusResponse {
@@ -195,8 +519,24 @@ func (c *StatusCache) Get() *StatusResponse {
 	return c.response
 }
 
+// Snapshot returns the serialized form of the latest StatusResponse in the
+// given API version.
+func (c *StatusCache) Snapshot(version string) *statusSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.snapshots[version]
+}
+
 func (c *StatusCache) Set(r *StatusResponse) {
+	snaps := make(map[string]*statusSnapshot, len(apiVersions))
+	for _, v := range apiVersions {
+		snaps[v] = newStatusSnapshot(r, v)
+	}
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	c.response = r
+	c.snapshots = snaps
+	c.mu.Unlock()
+
+	c.publish(r)
 }